@@ -0,0 +1,69 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"net"
+
+	"github.com/google/uuid"
+)
+
+// Size of the session secrets and challenge nonces
+const secretSize = 32
+
+// Make a random secret or nonce
+func newSecret() []byte {
+	b := make([]byte, secretSize)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return b
+}
+
+// The proof a keeper gives of knowing the session secret when resuming,
+// bound to the server nonce and the offsets of both ends
+func resumeProof(secret, nonce []byte, id uuid.UUID, keeperOffset, serverOffset int64) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(nonce)
+	mac.Write(id[:])
+	binary.Write(mac, binary.BigEndian, keeperOffset)
+	binary.Write(mac, binary.BigEndian, serverOffset)
+	return mac.Sum(nil)
+}
+
+// Derive the secret to use after a successful resume, so a captured
+// handshake is of no use later on
+func rotateSecret(secret, nonce []byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte("rotate"))
+	mac.Write(nonce)
+	return mac.Sum(nil)
+}
+
+// Send a header and read back the reply, answering a resume challenge with
+// proof of the session secret and rotating the secret once accepted
+func handshake(dstConn net.Conn, hdr ConnHeader, opts map[byte][]byte, secret *[]byte) (ConnHeader, map[byte][]byte, error) {
+	if err := writeHeader(dstConn, hdr, opts); err != nil {
+		return ConnHeader{}, nil, err
+	}
+	rcvHdr, rcvOpts, err := readHeader(dstConn)
+	if err != nil || rcvHdr.Kind != hdrChallenge {
+		return rcvHdr, rcvOpts, err
+	} else if secret == nil {
+		return rcvHdr, rcvOpts, errors.New("Unexpected challenge")
+	}
+	nonce := rcvOpts[optNonce]
+	proof := resumeProof(*secret, nonce, hdr.UUID, hdr.Offset, rcvHdr.Offset)
+	if err = writeHeader(dstConn, newHeader(hdrProof, hdr.UUID, hdr.Offset),
+		map[byte][]byte{optProof: proof}); err != nil {
+		return ConnHeader{}, nil, err
+	}
+	if rcvHdr, rcvOpts, err = readHeader(dstConn); err == nil &&
+		(rcvHdr.Kind == hdrEstablished || rcvHdr.Kind == hdrClosed) {
+		*secret = rotateSecret(*secret, nonce)
+	}
+	return rcvHdr, rcvOpts, err
+}
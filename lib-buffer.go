@@ -0,0 +1,295 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+var errBufferFreed = errors.New("buffer has been freed")
+
+const keepCap = 16 << 10 // most room an emptied buffer holds on to
+
+// A replayBuffer keeps every byte handed to the remote end until the remote
+// acknowledges it, so that a transport drop never loses in flight data.
+type replayBuffer struct {
+	mutex sync.Mutex
+	cond  sync.Cond
+	buf   bytes.Buffer
+	start int64 // stream offset of the first byte held
+	sent  int64 // stream offset of the next byte to send
+	freed bool
+
+	unlimited bool          // writes go ahead past the limits, while being handed off
+	limit     int           // most bytes held before writes wait, 0 for no limit
+	budget    *memoryBudget // shared with other buffers, may be nil
+	spill     *spillStore   // where bytes past the limit go instead, may be nil
+	err       error         // the spill store has failed
+}
+
+// Append local data to the end of the stream, waiting while the buffer is at
+// its limit so the caller stops reading and the sender is held back
+func (b *replayBuffer) Write(p []byte) (int, error) {
+	if b.spill != nil {
+		return b.spillWrite(p)
+	}
+	if err := b.budget.take(len(p)); err != nil {
+		return 0, err
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.cond.L == nil {
+		b.cond.L = &b.mutex
+	}
+	for !b.freed && !b.unlimited && b.limit > 0 && b.buf.Len() > 0 && b.buf.Len()+len(p) > b.limit {
+		b.cond.Wait()
+	}
+	if b.freed {
+		b.budget.release(len(p))
+		return 0, errBufferFreed
+	}
+	return b.buf.Write(p)
+}
+
+// Number of bytes held, sent or not, awaiting acknowledgement
+func (b *replayBuffer) Len() int {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buf.Len() + int(b.spill.len())
+}
+
+// Number of bytes held which have not yet been sent
+func (b *replayBuffer) Unsent() int {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return int(b.start + int64(b.buf.Len()) + b.spill.len() - b.sent)
+}
+
+// Return a copy of up to max bytes which have not yet been sent, along with
+// the stream offset just past them.  An error means the bytes held on disk
+// could not be read back, the stream cannot go on.
+func (b *replayBuffer) Peek(max int) ([]byte, int64, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.sent == b.start+int64(b.buf.Len()) && b.spill.len() > 0 {
+		// Everything in memory has gone out, bring in more from disk
+		if _, err := b.refill(true); err != nil {
+			return nil, b.sent, err
+		}
+	}
+	pending := b.buf.Bytes()[b.sent-b.start:]
+	if len(pending) > max {
+		pending = pending[:max]
+	}
+	return append([]byte(nil), pending...), b.sent + int64(len(pending)), nil
+}
+
+// Mark everything up to the offset as sent, it is still held until
+// acknowledged
+func (b *replayBuffer) Sent(off int64) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if off > b.sent {
+		b.sent = off
+	}
+}
+
+// Release all the bytes before the offset the remote has confirmed
+func (b *replayBuffer) Ack(off int64) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.ack(off)
+}
+
+func (b *replayBuffer) ack(off int64) error {
+	if end := b.start + int64(b.buf.Len()) + b.spill.len(); off < b.start || off > end {
+		return fmt.Errorf("offset %d outside of buffer %d-%d", off, b.start, end)
+	}
+	for off > b.start+int64(b.buf.Len()) {
+		if _, err := b.refill(true); err != nil {
+			return err
+		}
+	}
+	b.buf.Next(int(off - b.start))
+	if b.buf.Len() == 0 && b.buf.Cap() > keepCap {
+		// Let go of the room a burst needed, the session may now sit idle
+		b.buf = bytes.Buffer{}
+	}
+	b.budget.release(int(off - b.start))
+	b.start = off
+	if b.sent < off {
+		b.sent = off
+	}
+	// Keep memory topped up from disk as it drains
+	for {
+		if ok, err := b.refill(false); err != nil {
+			return err
+		} else if !ok {
+			break
+		}
+	}
+	b.cond.Broadcast()
+	return nil
+}
+
+// On resume, release what the remote has and send again everything after it
+func (b *replayBuffer) Rewind(off int64) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if err := b.ack(off); err != nil {
+		return err
+	}
+	b.sent = off
+	return nil
+}
+
+// Let go of everything held, the stream cannot be resumed after this and
+// any waiting writes give up
+func (b *replayBuffer) Free() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.budget.release(b.buf.Len())
+	b.start += int64(b.buf.Len()) + b.spill.len()
+	b.sent = b.start
+	b.buf = bytes.Buffer{}
+	b.spill.close()
+	b.freed = true
+	b.cond.Broadcast()
+}
+
+// Let waiting writes go ahead past the limits, or hold them to the limits
+// again
+func (b *replayBuffer) SetUnlimited(on bool) {
+	b.mutex.Lock()
+	b.unlimited = on
+	b.cond.Broadcast()
+	b.mutex.Unlock()
+}
+
+// The stream offset of the first byte held
+func (b *replayBuffer) Start() int64 {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.start
+}
+
+// Hand every byte held, in order, to fn, for moving the buffer elsewhere
+func (b *replayBuffer) Export(fn func([]byte) error) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	for held := b.buf.Bytes(); len(held) > 0; {
+		n := len(held)
+		if n > spillChunk {
+			n = spillChunk
+		}
+		if err := fn(held[:n]); err != nil {
+			return err
+		}
+		held = held[n:]
+	}
+	return b.spill.each(fn)
+}
+
+// Start an empty buffer at a stream offset, for bytes moved from elsewhere
+func (b *replayBuffer) Restore(start int64) {
+	b.mutex.Lock()
+	b.start, b.sent = start, start
+	b.mutex.Unlock()
+}
+
+// Append bytes moved from elsewhere, past any limits as they were already
+// accepted from the local end
+func (b *replayBuffer) Import(p []byte) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.spill.len() > 0 || b.spill != nil && b.limit > 0 && b.buf.Len()+len(p) > b.limit {
+		_, err := b.spill.write(p)
+		return err
+	}
+	b.budget.add(len(p))
+	_, err := b.buf.Write(p)
+	return err
+}
+
+// A memoryBudget caps the bytes held across many replay buffers, and may
+// itself count against a larger parent budget
+type memoryBudget struct {
+	mutex     sync.Mutex
+	cond      sync.Cond
+	used      int
+	max       int
+	unlimited bool
+	parent    *memoryBudget
+}
+
+func newMemoryBudget(max int, parent *memoryBudget) *memoryBudget {
+	m := &memoryBudget{max: max, parent: parent}
+	m.cond.L = &m.mutex
+	return m
+}
+
+// Reserve room for n bytes, waiting for other buffers to release some when
+// the budget is spent
+func (m *memoryBudget) take(n int) error {
+	if m == nil {
+		return nil
+	}
+	m.mutex.Lock()
+	for !m.unlimited && m.used > 0 && m.used+n > m.max {
+		m.cond.Wait()
+	}
+	m.used += n
+	m.mutex.Unlock()
+	return m.parent.take(n)
+}
+
+// Let waiting writes go ahead past the budget, or hold them to it again
+func (m *memoryBudget) setUnlimited(on bool) {
+	if m == nil {
+		return
+	}
+	m.mutex.Lock()
+	m.unlimited = on
+	m.cond.Broadcast()
+	m.mutex.Unlock()
+}
+
+// Reserve room for n bytes, false without waiting when the budget is spent
+func (m *memoryBudget) tryTake(n int) bool {
+	if m == nil {
+		return true
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.used > 0 && m.used+n > m.max {
+		return false
+	}
+	if !m.parent.tryTake(n) {
+		return false
+	}
+	m.used += n
+	return true
+}
+
+// Count n bytes which must be held whether or not they fit
+func (m *memoryBudget) add(n int) {
+	if m == nil {
+		return
+	}
+	m.mutex.Lock()
+	m.used += n
+	m.mutex.Unlock()
+	m.parent.add(n)
+}
+
+func (m *memoryBudget) release(n int) {
+	if m == nil || n == 0 {
+		return
+	}
+	m.mutex.Lock()
+	m.used -= n
+	m.cond.Broadcast()
+	m.mutex.Unlock()
+	m.parent.release(n)
+}
@@ -1,15 +1,156 @@
 package main
 
 import (
+	"bytes"
+	"encoding/binary"
 	"errors"
+	"fmt"
 	"io"
+	"time"
 
 	"github.com/google/uuid"
 )
 
+// The longest a server may spend opening the destination of a new session,
+// resolving the name and dialing every address it has, so a keeper waiting
+// on the reply always hears back a timeout before giving up itself
+const maxOpenTime = 10 * time.Second
+
+const (
+	protoMagic      uint32 = 0x534b5052 // "SKPR" starts every header
+	protoVersion    uint16 = 1          // newest version spoken by this build
+	protoMinVersion uint16 = 1          // oldest version still understood
+)
+
+// Kinds of header, the first few are sent by the keeper and the rest are the
+// server replies
+const (
+	hdrNew         uint16 = iota + 1 // open a new session to the optDest destination
+	hdrResume                        // resume a session, having received Offset bytes
+	hdrClose                         // the keeper has closed the session
+	hdrEstablished                   // the session is ready, having received Offset bytes
+	hdrClosed                        // the server end has closed and everything was acknowledged
+	hdrError                         // the request was refused, an error frame follows
+	hdrChallenge                     // prove knowledge of the session secret for the optNonce
+	hdrProof                         // the optProof answering a challenge
+	hdrMux                           // carry many sessions as streams over this transport
+	hdrLookup                        // a cluster peer asks whether this server holds the session
+)
+
+// Capability flags, a feature is only used when both ends advertise it
+const (
+	capPing  uint32 = 1 << iota // answers ping frames with pong
+	capAuth                     // resumes are authenticated with the session secret
+	capMux                      // sessions may be multiplexed over one transport
+	capEpoch                    // resumes carry an increasing optEpoch
+)
+
+// Capabilities this build supports
+const protoCaps = capPing | capAuth | capMux | capEpoch
+
+// Options carried after a header, encoded the same way as frames
+const (
+	optDest      byte = iota + 1 // host:port to dial for a new session
+	optSecret                    // secret handed to the keeper for proving later resumes
+	optNonce                     // random challenge for a resume
+	optProof                     // HMAC of the challenge with the session secret
+	optListen                    // [bind:]port for the server to listen on for a reverse tunnel
+	optServer                    // identity of the server process, so a keeper knows which addresses reach it
+	optForwarded                 // sent on by a cluster peer, not to be forwarded again
+	optToken                     // pre-shared token identifying the keeper for a new session
+	optEpoch                     // count of resumes made, a later transport always has a higher one
+)
+
+// The header exchanged each time a transport is opened, followed by OptLen
+// bytes of options
 type ConnHeader struct {
-	UUID   uuid.UUID
-	Offset int64
+	Magic   uint32
+	Version uint16
+	Kind    uint16
+	Caps    uint32
+	UUID    uuid.UUID
+	Offset  int64
+	OptLen  uint16
+}
+
+var errBadMagic = errors.New("Not a session-keeper header")
+
+// Build a header with the version and capabilities of this build
+func newHeader(kind uint16, id uuid.UUID, offset int64) ConnHeader {
+	return ConnHeader{Magic: protoMagic, Version: protoVersion, Kind: kind,
+		Caps: protoCaps, UUID: id, Offset: offset}
+}
+
+// Build the reply to a header, settling on the version and capabilities both
+// ends share
+func replyHeader(hello ConnHeader, kind uint16, offset int64) ConnHeader {
+	hdr := newHeader(kind, hello.UUID, offset)
+	if hello.Version < hdr.Version {
+		hdr.Version = hello.Version
+	}
+	hdr.Caps &= hello.Caps
+	return hdr
+}
+
+// Write out a header and its options in one go
+func writeHeader(w io.Writer, hdr ConnHeader, opts map[byte][]byte) error {
+	var optBuf bytes.Buffer
+	for typ, val := range opts {
+		writeFrame(&optBuf, typ, val)
+	}
+	hdr.OptLen = uint16(optBuf.Len())
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, hdr)
+	buf.Write(optBuf.Bytes())
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// Read in a header and its options, refusing anything without the magic
+func readHeader(r io.Reader) (hdr ConnHeader, opts map[byte][]byte, err error) {
+	if err = binary.Read(r, binary.BigEndian, &hdr); err != nil {
+		return
+	}
+	if hdr.Magic != protoMagic {
+		err = errBadMagic
+		return
+	}
+	optBuf := make([]byte, hdr.OptLen)
+	if _, err = io.ReadFull(r, optBuf); err != nil {
+		return
+	}
+	opts = make(map[byte][]byte)
+	for optR := bytes.NewReader(optBuf); optR.Len() > 0; {
+		typ, val, err := readFrame(optR)
+		if err != nil {
+			return hdr, nil, fmt.Errorf("Bad header options: %s", err)
+		}
+		opts[typ] = val
+	}
+	return
+}
+
+// Encode a resume epoch for the optEpoch option
+func epochOpt(epoch uint64) []byte {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], epoch)
+	return b[:]
+}
+
+// The resume epoch given in the options, 0 when there is none
+func parseEpoch(opts map[byte][]byte) uint64 {
+	if b := opts[optEpoch]; len(b) == 8 {
+		return binary.BigEndian.Uint64(b)
+	}
+	return 0
+}
+
+// Turn down a request with a reason the remote can report
+func refuse(w io.Writer, hello ConnHeader, code uint16, msg string) error {
+	if err := writeHeader(w, replyHeader(hello, hdrError, 0), nil); err != nil {
+		return err
+	}
+	return writeError(w, code, msg)
 }
 
 // Read one character at a time and return the string slurped in with a maximum size
@@ -0,0 +1,47 @@
+package main
+
+import "time"
+
+// A wakeup tells the goroutine writing a session out that there is something
+// for it to do: data to send, an acknowledgement owed, or the transport or
+// local connection gone.  Notifications made while it is busy fold into one,
+// so none is lost and notifying never blocks.
+type wakeup chan struct{}
+
+func newWakeup() wakeup { return make(wakeup, 1) }
+
+func (w wakeup) notify() {
+	select {
+	case w <- struct{}{}:
+	default:
+	}
+}
+
+// An alarm is a timer which may be off, its channel is then nil so a select
+// on it never fires and an idle session costs nothing
+type alarm struct {
+	t *time.Timer
+	C <-chan time.Time
+}
+
+// Fire once after d, in place of any time set before
+func (a *alarm) set(d time.Duration) {
+	if a.t == nil {
+		a.t = time.NewTimer(d)
+	} else {
+		a.stop()
+		a.t.Reset(d)
+	}
+	a.C = a.t.C
+}
+
+// Turn the alarm off
+func (a *alarm) stop() {
+	if a.t != nil && !a.t.Stop() {
+		select {
+		case <-a.t.C:
+		default:
+		}
+	}
+	a.C = nil
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Once the headers are exchanged, everything on a transport is sent as a
+// frame: one type byte, a two byte length and the payload.  Unknown frame
+// types are skipped so newer builds may add their own.
+const (
+	frameData  byte = iota + 1 // stream bytes for the remote end
+	frameAck                   // cumulative count of stream bytes received
+	framePing                  // asks for a pong carrying the same payload
+	framePong                  // answer to a ping
+	frameClose                 // the session is over, with a reason code
+	frameError                 // a failure code and message, the transport is dropped after
+)
+
+// Reasons given in a close frame
+const (
+	closeEOF   byte = iota + 1 // the local connection was closed
+	closeError                 // the local connection failed
+)
+
+// Failure codes given in an error frame
+const (
+	failProtocol uint16 = iota + 1 // the remote sent something unexpected
+	failVersion                    // no protocol version in common
+	failUnknown                    // no such session
+	failBuffer                     // the buffers could not be lined up on resume
+	failDenied                     // the destination is not allowed
+	failDial                       // the destination could not be reached
+	failAuth                       // the resume could not be authenticated
+	failExpired                    // the session was expired by the server
+	failResolve                    // the destination name could not be resolved
+	failRefused                    // the destination refused the connection
+	failTimeout                    // the destination did not answer in time
+	failStale                      // a resume with a later epoch has taken over the session
+)
+
+const (
+	maxFrameData = 10000                  // largest payload put in one data frame
+	ackEvery     = 1 << 16                // acknowledge straight away once this many bytes are unacknowledged
+	ackDelay     = 200 * time.Millisecond // otherwise wait this long for more to acknowledge along with it
+)
+
+// The reason given by the remote end for failing a request
+type remoteError struct {
+	Code uint16
+	Msg  string
+}
+
+func (e *remoteError) Error() string {
+	return fmt.Sprintf("remote error %d: %s", e.Code, e.Msg)
+}
+
+// Write out a frame.  This is done in a single write so frames from
+// different goroutines do not interleave.
+func writeFrame(w io.Writer, typ byte, payload []byte) error {
+	buf := make([]byte, 3+len(payload))
+	buf[0] = typ
+	binary.BigEndian.PutUint16(buf[1:3], uint16(len(payload)))
+	copy(buf[3:], payload)
+	_, err := w.Write(buf)
+	return err
+}
+
+// Tell the remote how many bytes of the stream have been received
+func writeAck(w io.Writer, off int64) error {
+	var payload [8]byte
+	binary.BigEndian.PutUint64(payload[:], uint64(off))
+	return writeFrame(w, frameAck, payload[:])
+}
+
+// Tell the remote why the request or session failed
+func writeError(w io.Writer, code uint16, msg string) error {
+	payload := make([]byte, 2, 2+len(msg))
+	binary.BigEndian.PutUint16(payload, code)
+	return writeFrame(w, frameError, append(payload, msg...))
+}
+
+func readFrame(r io.Reader) (typ byte, payload []byte, err error) {
+	var hdr [3]byte
+	if _, err = io.ReadFull(r, hdr[:]); err != nil {
+		return
+	}
+	payload = make([]byte, binary.BigEndian.Uint16(hdr[1:3]))
+	if _, err = io.ReadFull(r, payload); err != nil {
+		return
+	}
+	return hdr[0], payload, nil
+}
+
+// Decode the offset carried in an ack frame
+func parseAck(payload []byte) (int64, error) {
+	if len(payload) != 8 {
+		return 0, errors.New("Bad ack frame")
+	}
+	return int64(binary.BigEndian.Uint64(payload)), nil
+}
+
+// Decode the failure carried in an error frame
+func parseError(payload []byte) error {
+	if len(payload) < 2 {
+		return &remoteError{Code: failProtocol, Msg: "bad error frame"}
+	}
+	return &remoteError{Code: binary.BigEndian.Uint16(payload), Msg: string(payload[2:])}
+}
+
+// Read the error frame which follows a refused header
+func readError(r io.Reader) error {
+	typ, payload, err := readFrame(r)
+	if err != nil {
+		return err
+	}
+	if typ != frameError {
+		return &remoteError{Code: failProtocol, Msg: "expected an error frame"}
+	}
+	return parseError(payload)
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"encoding/binary"
+	"time"
+)
+
+// A heartbeat notices a transport which has gone quiet, such as when a
+// firewall drops its state without sending a reset.  A ping goes out every
+// interval, and the reader gives up on the transport once nothing at all has
+// come in for the given number of intervals.
+type heartbeat struct {
+	interval time.Duration // 0 to turn heartbeats off
+	misses   int
+	pinged   time.Time
+}
+
+func newHeartbeat(interval time.Duration, misses int) *heartbeat {
+	if misses < 1 {
+		misses = 1
+	}
+	return &heartbeat{interval: interval, misses: misses}
+}
+
+// Report whether a ping should go out now, giving its payload
+func (h *heartbeat) due() ([]byte, bool) {
+	now := time.Now()
+	if h.interval <= 0 || now.Sub(h.pinged) < h.interval {
+		return nil, false
+	}
+	h.pinged = now
+	var payload [8]byte
+	binary.BigEndian.PutUint64(payload[:], uint64(now.UnixNano()))
+	return payload[:], true
+}
+
+// The read deadline by which something must come in, zero when heartbeats
+// are off
+func (h *heartbeat) deadline() time.Time {
+	if h.interval <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(h.interval * time.Duration(h.misses))
+}
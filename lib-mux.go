@@ -0,0 +1,379 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Frames carried on a multiplexed transport, each payload starts with the
+// four byte stream id
+const (
+	muxOpen   byte = iota + 1 // a new stream has been opened
+	muxData                   // stream bytes
+	muxWindow                 // the remote may send this many more bytes
+	muxClose                  // the stream is closed in both directions
+	muxPing                   // asks for a pong carrying the same payload, on stream 0
+	muxPong                   // answer to a ping
+)
+
+const (
+	muxWindowSize = 1 << 18 // bytes a stream may have in flight before waiting on the reader
+	muxChunk      = 16384   // largest payload put in one data frame
+	muxBacklog    = 64      // opened streams waiting to be accepted
+)
+
+// A muxConn carries many streams over one transport.  Every stream has its
+// own flow control window so a slow reader does not hold up the others.
+type muxConn struct {
+	conn    net.Conn
+	mutex   sync.Mutex
+	streams map[uint32]*muxStream
+	nextID  uint32
+	accept  chan *muxStream
+	closed  bool
+	hb      *heartbeat
+}
+
+// Start multiplexing over a transport, the two ends must differ in client so
+// their stream ids do not collide.  The heartbeat drops the whole transport
+// when it goes quiet, so every stream on it reconnects.
+func newMux(conn net.Conn, client bool, hb *heartbeat) *muxConn {
+	m := &muxConn{
+		conn:    conn,
+		streams: make(map[uint32]*muxStream),
+		nextID:  2,
+		accept:  make(chan *muxStream, muxBacklog),
+		hb:      hb,
+	}
+	if client {
+		m.nextID = 1
+	}
+	go m.readLoop()
+	if hb.interval > 0 {
+		go m.keepalive()
+	}
+	return m
+}
+
+// Open a new stream to the remote end
+func (m *muxConn) Open() (net.Conn, error) {
+	m.mutex.Lock()
+	if m.closed {
+		m.mutex.Unlock()
+		return nil, net.ErrClosed
+	}
+	s := m.newStream(m.nextID)
+	m.nextID += 2
+	m.mutex.Unlock()
+	if err := m.write(muxOpen, s.id, nil); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Wait for the remote end to open a stream
+func (m *muxConn) Accept() (net.Conn, error) {
+	s, ok := <-m.accept
+	if !ok {
+		return nil, net.ErrClosed
+	}
+	return s, nil
+}
+
+// Close the transport along with every stream on it
+func (m *muxConn) Close() error {
+	m.mutex.Lock()
+	if m.closed {
+		m.mutex.Unlock()
+		return nil
+	}
+	m.closed = true
+	streams := m.streams
+	m.streams = make(map[uint32]*muxStream)
+	close(m.accept)
+	m.mutex.Unlock()
+	for _, s := range streams {
+		s.reset()
+	}
+	return m.conn.Close()
+}
+
+// Report whether the transport has gone away
+func (m *muxConn) Closed() bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.closed
+}
+
+// Must be called with the mutex held
+func (m *muxConn) newStream(id uint32) *muxStream {
+	s := &muxStream{m: m, id: id, credit: muxWindowSize}
+	s.cond.L = &s.mutex
+	m.streams[id] = s
+	return s
+}
+
+func (m *muxConn) write(typ byte, id uint32, data []byte) error {
+	payload := make([]byte, 4, 4+len(data))
+	binary.BigEndian.PutUint32(payload, id)
+	return writeFrame(m.conn, typ, append(payload, data...))
+}
+
+// Ping the remote for as long as the transport is up
+func (m *muxConn) keepalive() {
+	t := time.NewTicker(m.hb.interval)
+	defer t.Stop()
+	for range t.C {
+		if m.Closed() {
+			return
+		}
+		if payload, ok := m.hb.due(); ok {
+			// Not waited on, a stuck write is let go when the reader gives up
+			go m.write(muxPing, 0, payload)
+		}
+	}
+}
+
+func (m *muxConn) readLoop() {
+	defer m.Close()
+	r := bufio.NewReader(m.conn)
+	for {
+		m.conn.SetReadDeadline(m.hb.deadline())
+		typ, payload, err := readFrame(r)
+		if err != nil || len(payload) < 4 {
+			return
+		}
+		id := binary.BigEndian.Uint32(payload)
+		payload = payload[4:]
+		switch typ {
+		case muxPing:
+			go m.write(muxPong, 0, payload)
+			continue
+		case muxPong:
+			continue
+		}
+
+		m.mutex.Lock()
+		s := m.streams[id]
+		if typ == muxOpen && s == nil && !m.closed {
+			s = m.newStream(id)
+			select {
+			case m.accept <- s:
+			default:
+				// Nobody is accepting, turn it away
+				delete(m.streams, id)
+				go m.write(muxClose, id, nil)
+			}
+		}
+		m.mutex.Unlock()
+		if s == nil {
+			continue // a stream already closed on this end
+		}
+
+		switch typ {
+		case muxData:
+			if !s.push(payload) {
+				return // the remote ignored the window
+			}
+		case muxWindow:
+			if len(payload) != 4 {
+				return
+			}
+			s.grant(int(binary.BigEndian.Uint32(payload)))
+		case muxClose:
+			s.reset()
+		}
+	}
+}
+
+// A muxStream is one stream of a muxConn, it behaves as a net.Conn
+type muxStream struct {
+	m      *muxConn
+	id     uint32
+	mutex  sync.Mutex
+	cond   sync.Cond
+	wmutex sync.Mutex // keeps each Write together on the transport
+
+	rbuf     bytes.Buffer
+	credit   int  // bytes which may still be sent
+	consumed int  // bytes read but not yet granted back to the remote
+	closed   bool // closed on this end
+	eof      bool // closed by the remote end or the transport
+
+	readDeadline, writeDeadline time.Time
+	readTimer, writeTimer       *time.Timer
+}
+
+// Queue data from the remote, false if it went past the window
+func (s *muxStream) push(data []byte) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		return true
+	}
+	s.rbuf.Write(data)
+	s.cond.Broadcast()
+	return s.rbuf.Len() <= muxWindowSize
+}
+
+// The remote has read some data, more may be sent
+func (s *muxStream) grant(n int) {
+	s.mutex.Lock()
+	s.credit += n
+	s.cond.Broadcast()
+	s.mutex.Unlock()
+}
+
+// The remote end or the transport has gone
+func (s *muxStream) reset() {
+	s.mutex.Lock()
+	s.eof = true
+	s.cond.Broadcast()
+	s.mutex.Unlock()
+	s.m.mutex.Lock()
+	delete(s.m.streams, s.id)
+	s.m.mutex.Unlock()
+}
+
+func (s *muxStream) Read(b []byte) (int, error) {
+	s.mutex.Lock()
+	for s.rbuf.Len() == 0 && !s.closed && !s.eof && !past(s.readDeadline) {
+		s.cond.Wait()
+	}
+	switch {
+	case s.closed:
+		s.mutex.Unlock()
+		return 0, net.ErrClosed
+	case s.rbuf.Len() == 0 && s.eof:
+		s.mutex.Unlock()
+		return 0, io.EOF
+	case s.rbuf.Len() == 0:
+		s.mutex.Unlock()
+		return 0, os.ErrDeadlineExceeded
+	}
+	n, _ := s.rbuf.Read(b)
+	s.consumed += n
+	grant := 0
+	if s.consumed >= muxWindowSize/2 {
+		grant, s.consumed = s.consumed, 0
+	}
+	s.mutex.Unlock()
+	if grant > 0 {
+		var payload [4]byte
+		binary.BigEndian.PutUint32(payload[:], uint32(grant))
+		s.m.write(muxWindow, s.id, payload[:])
+	}
+	return n, nil
+}
+
+func (s *muxStream) Write(b []byte) (n int, err error) {
+	s.wmutex.Lock()
+	defer s.wmutex.Unlock()
+	for len(b) > 0 {
+		s.mutex.Lock()
+		for s.credit == 0 && !s.closed && !s.eof && !past(s.writeDeadline) {
+			s.cond.Wait()
+		}
+		switch {
+		case s.closed || s.eof:
+			s.mutex.Unlock()
+			return n, net.ErrClosed
+		case s.credit == 0:
+			s.mutex.Unlock()
+			return n, os.ErrDeadlineExceeded
+		}
+		chunk := len(b)
+		if chunk > s.credit {
+			chunk = s.credit
+		}
+		if chunk > muxChunk {
+			chunk = muxChunk
+		}
+		s.credit -= chunk
+		s.mutex.Unlock()
+		if err = s.m.write(muxData, s.id, b[:chunk]); err != nil {
+			s.m.Close()
+			return n, err
+		}
+		n += chunk
+		b = b[chunk:]
+	}
+	return n, nil
+}
+
+func (s *muxStream) Close() error {
+	s.mutex.Lock()
+	if s.closed {
+		s.mutex.Unlock()
+		return nil
+	}
+	s.closed = true
+	eof := s.eof
+	s.cond.Broadcast()
+	s.mutex.Unlock()
+	if !eof {
+		s.m.mutex.Lock()
+		delete(s.m.streams, s.id)
+		s.m.mutex.Unlock()
+		s.m.write(muxClose, s.id, nil)
+	}
+	return nil
+}
+
+// The transport carrying this stream, for looking at its TLS state
+func (s *muxStream) Transport() net.Conn { return s.m.conn }
+
+func (s *muxStream) LocalAddr() net.Addr  { return s.m.conn.LocalAddr() }
+func (s *muxStream) RemoteAddr() net.Addr { return s.m.conn.RemoteAddr() }
+
+func (s *muxStream) SetDeadline(t time.Time) error {
+	s.SetReadDeadline(t)
+	return s.SetWriteDeadline(t)
+}
+
+func (s *muxStream) SetReadDeadline(t time.Time) error {
+	s.mutex.Lock()
+	s.readDeadline = t
+	s.wakeAt(&s.readTimer, t)
+	s.mutex.Unlock()
+	return nil
+}
+
+func (s *muxStream) SetWriteDeadline(t time.Time) error {
+	s.mutex.Lock()
+	s.writeDeadline = t
+	s.wakeAt(&s.writeTimer, t)
+	s.mutex.Unlock()
+	return nil
+}
+
+// Wake any blocked Read or Write once a deadline passes, reusing the timer as
+// deadlines are often moved on every read.  Must be called with the mutex held.
+func (s *muxStream) wakeAt(timer **time.Timer, t time.Time) {
+	if *timer != nil {
+		(*timer).Stop()
+	}
+	if t.IsZero() {
+		return
+	}
+	if *timer == nil {
+		*timer = time.AfterFunc(time.Until(t), func() {
+			s.mutex.Lock()
+			s.cond.Broadcast()
+			s.mutex.Unlock()
+		})
+		return
+	}
+	(*timer).Reset(time.Until(t))
+}
+
+// Report whether a deadline is set and has passed
+func past(t time.Time) bool {
+	return !t.IsZero() && !time.Now().Before(t)
+}
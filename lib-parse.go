@@ -1,6 +1,7 @@
 package main
 
 import (
+	"errors"
 	"log"
 	"strconv"
 	"strings"
@@ -33,3 +34,36 @@ func hypenRange(r string) (out map[int]struct{}) {
 	}
 	return
 }
+
+// A listFlag collects every use of a repeatable flag
+type listFlag []string
+
+func (l *listFlag) String() string { return strings.Join(*l, ",") }
+
+func (l *listFlag) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
+
+// A sizeFlag is a byte count given with an optional K, M or G suffix
+type sizeFlag int
+
+func (s *sizeFlag) String() string { return strconv.Itoa(int(*s)) }
+
+func (s *sizeFlag) Set(v string) error {
+	mult := 1
+	switch {
+	case strings.HasSuffix(strings.ToUpper(v), "K"):
+		mult = 1 << 10
+	case strings.HasSuffix(strings.ToUpper(v), "M"):
+		mult = 1 << 20
+	case strings.HasSuffix(strings.ToUpper(v), "G"):
+		mult = 1 << 30
+	}
+	n, err := strconv.Atoi(strings.TrimRight(v, "KkMmGg"))
+	if err != nil || n < 0 {
+		return errors.New("invalid size " + v)
+	}
+	*s = sizeFlag(n * mult)
+	return nil
+}
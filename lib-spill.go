@@ -0,0 +1,205 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+)
+
+const (
+	spillSegment = 64 << 20          // bytes written to a segment file before starting the next
+	spillChunk   = 1 << 20           // bytes read back into memory at a time
+	spillPattern = "session-*.spill" // names of the segment files
+)
+
+// A spillStore holds the tail of a replay buffer in segment files on disk,
+// oldest first.  The files are unlinked as soon as they are made where the
+// system allows it, so nothing is left behind if the process dies.
+type spillStore struct {
+	dir  string
+	max  int64 // most bytes on disk before writes wait, 0 for no limit
+	segs []*spillFile
+	size int64
+}
+
+type spillFile struct {
+	f    *os.File
+	name string // to remove once closed, if it could not be unlinked while open
+	size int    // bytes written
+	read int    // bytes read back
+}
+
+// Make a store in the directory, nil when no directory is given
+func newSpill(dir string, max int64) *spillStore {
+	if dir == "" {
+		return nil
+	}
+	return &spillStore{dir: dir, max: max}
+}
+
+// Make sure the directory is there and clear out any segments left over from
+// a process which did not get to clean up
+func sweepSpill(dir string) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	old, err := filepath.Glob(filepath.Join(dir, spillPattern))
+	for _, name := range old {
+		// Fails for segments still open by a running process on Windows
+		os.Remove(name)
+	}
+	return err
+}
+
+// Number of bytes on disk
+func (s *spillStore) len() int64 {
+	if s == nil {
+		return 0
+	}
+	return s.size
+}
+
+// Size of the next chunk to be read back
+func (s *spillStore) headLen() int {
+	if s == nil || len(s.segs) == 0 {
+		return 0
+	}
+	seg := s.segs[0]
+	if seg.size-seg.read > spillChunk {
+		return spillChunk
+	}
+	return seg.size - seg.read
+}
+
+// Report whether n more bytes would go past the limit
+func (s *spillStore) full(n int) bool {
+	return s.max > 0 && s.size > 0 && s.size+int64(n) > s.max
+}
+
+// Append to the newest segment, starting a new one when it has grown enough
+func (s *spillStore) write(p []byte) (int, error) {
+	var seg *spillFile
+	if len(s.segs) > 0 {
+		seg = s.segs[len(s.segs)-1]
+	}
+	if seg == nil || seg.size >= spillSegment {
+		f, err := os.CreateTemp(s.dir, spillPattern)
+		if err != nil {
+			return 0, err
+		}
+		seg = &spillFile{f: f}
+		if os.Remove(f.Name()) != nil {
+			seg.name = f.Name()
+		}
+		s.segs = append(s.segs, seg)
+	}
+	n, err := seg.f.Write(p)
+	seg.size += n
+	s.size += int64(n)
+	return n, err
+}
+
+// Read back the next chunk, dropping the oldest segment once all of it has
+// been read.  Nothing is taken off the store when the read fails.
+func (s *spillStore) next() ([]byte, error) {
+	seg := s.segs[0]
+	data := make([]byte, s.headLen())
+	if _, err := seg.f.ReadAt(data, int64(seg.read)); err != nil {
+		return nil, err
+	}
+	seg.read += len(data)
+	s.size -= int64(len(data))
+	if seg.read == seg.size {
+		s.segs = s.segs[1:]
+		seg.close()
+	}
+	return data, nil
+}
+
+// Hand what is still to be read back, in order, to fn
+func (s *spillStore) each(fn func([]byte) error) error {
+	if s == nil {
+		return nil
+	}
+	for _, seg := range s.segs {
+		for off := seg.read; off < seg.size; off += spillChunk {
+			data := make([]byte, seg.size-off)
+			if len(data) > spillChunk {
+				data = data[:spillChunk]
+			}
+			if _, err := seg.f.ReadAt(data, int64(off)); err != nil {
+				return err
+			}
+			if err := fn(data); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Drop every segment
+func (s *spillStore) close() {
+	if s == nil {
+		return
+	}
+	for _, seg := range s.segs {
+		seg.close()
+	}
+	s.segs, s.size = nil, 0
+}
+
+func (seg *spillFile) close() {
+	seg.f.Close()
+	if seg.name != "" {
+		os.Remove(seg.name)
+	}
+}
+
+// Append to the buffer, keeping to memory while it is under the limit and
+// the memory budget allows, then going to disk and only waiting once the disk
+// limit is reached as well
+func (b *replayBuffer) spillWrite(p []byte) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.cond.L == nil {
+		b.cond.L = &b.mutex
+	}
+	for !b.freed && !b.unlimited && b.err == nil && b.spill.full(len(p)) {
+		b.cond.Wait()
+	}
+	switch {
+	case b.freed:
+		return 0, errBufferFreed
+	case b.err != nil:
+		return 0, b.err
+	case b.spill.len() == 0 && (b.limit == 0 || b.buf.Len()+len(p) <= b.limit) && b.budget.tryTake(len(p)):
+		return b.buf.Write(p)
+	}
+	n, err := b.spill.write(p)
+	if err != nil {
+		b.err = err
+	}
+	return n, err
+}
+
+// Move the next chunk from disk into memory, when it fits or is forced
+// because it is needed now.  Reports whether anything was moved, a failed
+// read moves nothing and leaves the stream as it was.
+func (b *replayBuffer) refill(force bool) (bool, error) {
+	n := b.spill.headLen()
+	if n == 0 {
+		return false, nil
+	}
+	if force {
+		b.budget.add(n)
+	} else if b.limit > 0 && b.buf.Len()+n > b.limit || !b.budget.tryTake(n) {
+		return false, nil
+	}
+	data, err := b.spill.next()
+	if err != nil {
+		b.budget.release(n)
+		return false, err
+	}
+	b.buf.Write(data)
+	return true, nil
+}
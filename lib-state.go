@@ -0,0 +1,74 @@
+package main
+
+import "sync"
+
+// Where a session is in its life, the same on both ends.  A session goes back
+// and forth between established, detached and resuming as transports come
+// and go, always resuming on the way back to established, but once closing
+// it can only go on to closed.
+type sessionState int
+
+const (
+	stateConnecting  sessionState = iota // the first transport is being opened
+	stateEstablished                     // a transport is attached and carrying data
+	stateDetached                        // the transport was lost, waiting for a resume
+	stateResuming                        // a new transport is being attached
+	stateClosing                         // the local connection is done, what is left is being delivered
+	stateClosed                          // over, nothing more is sent or accepted
+)
+
+var stateNames = [...]string{"connecting", "established", "detached", "resuming", "closing", "closed"}
+
+func (s sessionState) String() string { return stateNames[s] }
+
+// The moves allowed out of each state.  A session is picked up detached when
+// handed over from another server, and attached by resuming when the server
+// opened it, so neither always starts by connecting.
+var stateMoves = [...][]sessionState{
+	stateConnecting:  {stateEstablished, stateDetached, stateResuming, stateClosing, stateClosed},
+	stateEstablished: {stateDetached, stateResuming, stateClosing, stateClosed},
+	stateDetached:    {stateResuming, stateClosing, stateClosed},
+	stateResuming:    {stateEstablished, stateDetached, stateClosing, stateClosed},
+	stateClosing:     {stateClosed},
+	stateClosed:      nil,
+}
+
+// Whether a session may move from one state to the next, staying put is
+// allowed short of closed
+func canMove(from, next sessionState) bool {
+	if from == next {
+		return from != stateClosed
+	}
+	for _, s := range stateMoves[from] {
+		if s == next {
+			return true
+		}
+	}
+	return false
+}
+
+// A lifecycle holds the state of a session for the goroutines working on it
+type lifecycle struct {
+	mutex sync.Mutex
+	state sessionState
+}
+
+// Move on to the next state, false when the move is not allowed
+func (l *lifecycle) to(next sessionState) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if !canMove(l.state, next) {
+		return false
+	}
+	l.state = next
+	return true
+}
+
+func (l *lifecycle) get() sessionState {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.state
+}
+
+// Whether the local connection is done with, the session closing or closed
+func (l *lifecycle) ending() bool { return l.get() >= stateClosing }
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestLifecycleMoves(t *testing.T) {
+	tests := []struct {
+		from, next sessionState
+		ok         bool
+	}{
+		{stateConnecting, stateEstablished, true},
+		{stateConnecting, stateResuming, true},
+		{stateConnecting, stateDetached, true},
+		{stateEstablished, stateDetached, true},
+		{stateEstablished, stateResuming, true},
+		{stateEstablished, stateConnecting, false},
+		{stateDetached, stateResuming, true},
+		{stateDetached, stateEstablished, false},
+		{stateDetached, stateConnecting, false},
+		{stateResuming, stateEstablished, true},
+		{stateResuming, stateDetached, true},
+		{stateResuming, stateResuming, true},
+		{stateResuming, stateClosing, true},
+		{stateClosing, stateClosing, true},
+		{stateClosing, stateEstablished, false},
+		{stateClosing, stateDetached, false},
+		{stateClosing, stateClosed, true},
+		{stateClosed, stateClosed, false},
+		{stateClosed, stateEstablished, false},
+		{stateClosed, stateClosing, false},
+	}
+	for _, tt := range tests {
+		l := lifecycle{state: tt.from}
+		if ok := l.to(tt.next); ok != tt.ok {
+			t.Errorf("%s to %s: got %v, want %v", tt.from, tt.next, ok, tt.ok)
+		}
+		want := tt.from
+		if tt.ok {
+			want = tt.next
+		}
+		if got := l.get(); got != want {
+			t.Errorf("%s to %s: left in %s, want %s", tt.from, tt.next, got, want)
+		}
+	}
+}
+
+// Transports coming and going while the session closes must never bring it
+// back from closing
+func TestLifecycleConcurrent(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		var l lifecycle
+		l.to(stateEstablished)
+		var wg sync.WaitGroup
+		for _, path := range [][]sessionState{
+			{stateDetached, stateResuming, stateEstablished},
+			{stateResuming, stateEstablished, stateDetached},
+			{stateClosing},
+		} {
+			wg.Add(1)
+			go func(path []sessionState) {
+				defer wg.Done()
+				for j := 0; j < 50; j++ {
+					for _, s := range path {
+						l.to(s)
+					}
+				}
+			}(path)
+		}
+		wg.Wait()
+		if !l.ending() {
+			t.Fatalf("session left %s after closing", l.get())
+		}
+	}
+}
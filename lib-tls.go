@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Load a PEM file of certificates into a pool
+func loadCertPool(file string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("No certificates found in %s", file)
+	}
+	return pool, nil
+}
+
+// Load a certificate and key pair when both are given
+func loadKeyPair(certFile, keyFile string) ([]tls.Certificate, error) {
+	if certFile == "" && keyFile == "" {
+		return nil, nil
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	return []tls.Certificate{cert}, nil
+}
+
+// The SHA-256 of the certificate public key info, the same value as given by
+//
+//	openssl x509 -pubkey -noout | openssl pkey -pubin -outform der | openssl dgst -sha256
+func spkiFingerprint(cert *x509.Certificate) []byte {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return sum[:]
+}
+
+// Parse a pinned fingerprint given as hex (colons allowed) or as base64 in the
+// curl style of sha256//...
+func parsePin(pin string) ([]byte, error) {
+	var fp []byte
+	var err error
+	if strings.HasPrefix(pin, "sha256//") {
+		fp, err = base64.StdEncoding.DecodeString(strings.TrimPrefix(pin, "sha256//"))
+	} else {
+		fp, err = hex.DecodeString(strings.ReplaceAll(pin, ":", ""))
+	}
+	if err == nil && len(fp) != sha256.Size {
+		err = fmt.Errorf("Pin is %d bytes, not the %d of a SHA-256 fingerprint", len(fp), sha256.Size)
+	}
+	return fp, err
+}
+
+// Build a check which accepts only the peer whose public key matches the pin,
+// also verifying the chain when a pool is given
+func verifyPinned(pin []byte, pool *x509.CertPool) func(tls.ConnectionState) error {
+	return func(cs tls.ConnectionState) error {
+		if len(cs.PeerCertificates) == 0 {
+			return errors.New("No peer certificate")
+		}
+		if pool != nil {
+			opts := x509.VerifyOptions{Roots: pool, DNSName: cs.ServerName, Intermediates: x509.NewCertPool()}
+			for _, cert := range cs.PeerCertificates[1:] {
+				opts.Intermediates.AddCert(cert)
+			}
+			if _, err := cs.PeerCertificates[0].Verify(opts); err != nil {
+				return err
+			}
+		}
+		if !bytes.Equal(spkiFingerprint(cs.PeerCertificates[0]), pin) {
+			return fmt.Errorf("Peer key fingerprint %x does not match pin",
+				spkiFingerprint(cs.PeerCertificates[0]))
+		}
+		return nil
+	}
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unsafe"
+
+	mrand "math/rand"
+
+	"github.com/google/uuid"
+)
+
+var (
+	target   = flag.String("target", "localhost:2020", "Session-server to open the sessions on")
+	dest     = flag.String("dest", "127.0.0.1:2700", "Echo destination the sessions connect to")
+	echo     = flag.Bool("echo", false, "Only run the echo destination, listening on -dest")
+	count    = flag.Int("sessions", 20000, "Sessions to open and hold")
+	parallel = flag.Int("parallel", 32, "Sessions opened or resumed at once")
+	active   = flag.Int("active", 50, "Sessions resumed and sent data each round, the rest stay idle and detached")
+	round    = flag.Duration("round", time.Second, "Time between rounds of resumes")
+	duration = flag.Duration("duration", 5*time.Minute, "How long to keep resuming sessions once they are all open")
+	report   = flag.Duration("report", 10*time.Second, "How often to report progress")
+	pid      = flag.Int("pid", 0, "Process id of the session-server, to report its memory use")
+	version  string
+
+	opened, resumed, failed int64
+)
+
+// What the benchmark keeps of a session between resumes
+type benchSession struct {
+	id     uuid.UUID
+	secret []byte
+	offset int64 // bytes received from the server
+	epoch  uint64
+}
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Session-Bench (github.com/pschou/session-keeper, version: %s)\n\nUsage: %s [options]\n",
+			version, os.Args[0])
+
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() > 0 {
+		fmt.Println("Unknown flag", flag.Args())
+		flag.Usage()
+		os.Exit(1)
+	}
+	// Every session holds a destination socket in the echo process and the
+	// server, while the benchmark itself only holds the transports in use
+	if *echo {
+		raiseFileLimit(0, uint64(*count)+fileSlack)
+		echoServer(*dest)
+		return
+	}
+	raiseFileLimit(0, uint64(*parallel)+fileSlack)
+	if *pid != 0 {
+		raiseFileLimit(*pid, uint64(*count+*parallel)+fileSlack)
+	}
+
+	start := time.Now()
+	go func() {
+		for range time.Tick(*report) {
+			fmt.Printf("t=%-6s opened=%d resumed=%d failed=%d %s\n", time.Since(start).Round(time.Second),
+				atomic.LoadInt64(&opened), atomic.LoadInt64(&resumed), atomic.LoadInt64(&failed), serverMemory())
+		}
+	}()
+
+	// Open every session, each is left detached once it has carried some data
+	sessions := make([]*benchSession, *count)
+	each(len(sessions), func(i int) {
+		for sessions[i] == nil {
+			s, err := openSession()
+			if err != nil {
+				atomic.AddInt64(&failed, 1)
+				fmt.Println("Error opening session:", err)
+				time.Sleep(time.Second)
+				continue
+			}
+			sessions[i] = s
+			atomic.AddInt64(&opened, 1)
+		}
+	})
+	fmt.Println("Opened", len(sessions), "sessions in", time.Since(start).Round(time.Second), serverMemory())
+
+	// Now resume a few at random each round, as keepers coming back would
+	end := time.Now().Add(*duration)
+	for time.Now().Before(end) {
+		next := time.Now().Add(*round)
+		picked := mrand.Perm(len(sessions))
+		if len(picked) > *active {
+			picked = picked[:*active]
+		}
+		each(len(picked), func(i int) {
+			if err := sessions[picked[i]].resume(); err != nil {
+				atomic.AddInt64(&failed, 1)
+				fmt.Println("Error resuming session:", err)
+				return
+			}
+			atomic.AddInt64(&resumed, 1)
+		})
+		time.Sleep(time.Until(next))
+	}
+	fmt.Printf("Done opened=%d resumed=%d failed=%d %s\n",
+		atomic.LoadInt64(&opened), atomic.LoadInt64(&resumed), atomic.LoadInt64(&failed), serverMemory())
+}
+
+// Open files a process needs besides those of the sessions, for its
+// listener, standard streams and runtime
+const fileSlack = 64
+
+// Make sure a process, 0 for this one, may hold the open files needed,
+// raising the hard limit too when that is allowed, and exit when it cannot
+func raiseFileLimit(pid int, need uint64) {
+	var lim syscall.Rlimit
+	if err := prlimit(pid, nil, &lim); err != nil {
+		fmt.Println("Error reading open file limit:", err)
+		os.Exit(1)
+	}
+	if lim.Cur >= need {
+		return
+	}
+	want := syscall.Rlimit{Cur: need, Max: lim.Max}
+	if want.Max < need {
+		want.Max = need
+	}
+	if err := prlimit(pid, &want, nil); err != nil {
+		fmt.Printf("Error raising the open file limit of process %d from %d (hard %d) to %d: %s\n",
+			pid, lim.Cur, lim.Max, need, err)
+		os.Exit(1)
+	}
+}
+
+// Get and set the open file limit of a process, as prlimit(2) does
+func prlimit(pid int, set, old *syscall.Rlimit) error {
+	_, _, errno := syscall.RawSyscall6(syscall.SYS_PRLIMIT64, uintptr(pid), syscall.RLIMIT_NOFILE,
+		uintptr(unsafe.Pointer(set)), uintptr(unsafe.Pointer(old)), 0, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// Run fn for 0 to n-1, -parallel at a time
+func each(n int, fn func(int)) {
+	var wg sync.WaitGroup
+	next := int64(-1)
+	for w := 0; w < *parallel; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := int(atomic.AddInt64(&next, 1)); i < n; i = int(atomic.AddInt64(&next, 1)) {
+				fn(i)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func openSession() (*benchSession, error) {
+	conn, err := net.Dial("tcp", *target)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+	s := &benchSession{id: uuid.New()}
+	rcvHdr, rcvOpts, err := handshake(conn, newHeader(hdrNew, s.id, 0),
+		map[byte][]byte{optDest: []byte(*dest)}, nil)
+	if err = checkReply(conn, rcvHdr, err); err != nil {
+		return nil, err
+	}
+	if s.secret = rcvOpts[optSecret]; len(s.secret) == 0 {
+		return nil, errors.New("no session secret handed over")
+	}
+	return s, s.exchange(conn)
+}
+
+// Attach to the session again, send it some data and detach
+func (s *benchSession) resume() error {
+	conn, err := net.Dial("tcp", *target)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+	s.epoch++
+	rcvHdr, _, err := handshake(conn, newHeader(hdrResume, s.id, s.offset),
+		map[byte][]byte{optEpoch: epochOpt(s.epoch)}, &s.secret)
+	if err = checkReply(conn, rcvHdr, err); err != nil {
+		return err
+	}
+	return s.exchange(conn)
+}
+
+func checkReply(conn net.Conn, rcvHdr ConnHeader, err error) error {
+	if err != nil {
+		return err
+	} else if rcvHdr.Kind == hdrError {
+		return readError(conn)
+	} else if rcvHdr.Kind != hdrEstablished {
+		return fmt.Errorf("unexpected header kind %d", rcvHdr.Kind)
+	}
+	return nil
+}
+
+// Send a little data through the session and wait for the echo of it, which
+// is acknowledged before the transport is dropped
+func (s *benchSession) exchange(conn net.Conn) error {
+	msg := make([]byte, 64)
+	rand.Read(msg)
+	if err := writeFrame(conn, frameData, msg); err != nil {
+		return err
+	}
+	r := bufio.NewReader(conn)
+	for got := 0; got < len(msg); {
+		typ, payload, err := readFrame(r)
+		if err != nil {
+			return err
+		}
+		switch typ {
+		case frameData:
+			got += len(payload)
+			s.offset += int64(len(payload))
+		case framePing:
+			writeFrame(conn, framePong, payload)
+		case frameClose:
+			return errors.New("session closed by the server")
+		case frameError:
+			return parseError(payload)
+		}
+	}
+	return writeAck(conn, s.offset)
+}
+
+// Echo back everything sent on each connection, with a small buffer so the
+// destination side of many idle sessions stays cheap
+func echoServer(addr string) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		fmt.Println("Error listening:", err)
+		os.Exit(1)
+	}
+	fmt.Println("Echoing on " + addr)
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			fmt.Println("Error accepting:", err)
+			time.Sleep(time.Second)
+			continue
+		}
+		go func(conn net.Conn) {
+			defer conn.Close()
+			buf := make([]byte, 512)
+			for {
+				n, err := conn.Read(buf)
+				if n > 0 {
+					if _, err := conn.Write(buf[:n]); err != nil {
+						return
+					}
+				}
+				if err != nil {
+					return
+				}
+			}
+		}(conn)
+	}
+}
+
+// The resident memory and thread count of the session-server, when its
+// process id was given
+func serverMemory() string {
+	if *pid == 0 {
+		return ""
+	}
+	b, err := os.ReadFile(fmt.Sprintf("/proc/%d/status", *pid))
+	if err != nil {
+		return "server " + err.Error()
+	}
+	var out []string
+	for _, line := range strings.Split(string(b), "\n") {
+		if strings.HasPrefix(line, "VmRSS:") || strings.HasPrefix(line, "Threads:") {
+			out = append(out, strings.Join(strings.Fields(line), " "))
+		}
+	}
+	return "server " + strings.Join(out, " ")
+}
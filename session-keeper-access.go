@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bufio"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+// Who may use the proxy listener, everyone when these are not set up
+var (
+	proxyUsers   map[string]string // user name to password hash, from -htpasswd
+	proxyClients []*net.IPNet      // source addresses allowed, from -clients
+)
+
+// Load an htpasswd file of user:hash lines, exiting when it is unusable.
+// Hashes may be Apache MD5 ($apr1$), SHA-1 ({SHA}) or plain text marked
+// with {PLAIN}, anything else is refused rather than taken as plain text.
+func loadHtpasswd(path string) {
+	f, err := os.Open(path)
+	if err != nil {
+		fmt.Println("Error opening htpasswd:", err)
+		os.Exit(1)
+	}
+	defer f.Close()
+	proxyUsers = make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		user, hash, ok := strings.Cut(line, ":")
+		if !ok {
+			fmt.Printf("Error in htpasswd line %d: missing :\n", n)
+			os.Exit(1)
+		}
+		switch {
+		case strings.HasPrefix(hash, "$apr1$"), strings.HasPrefix(hash, "{SHA}"), strings.HasPrefix(hash, "{PLAIN}"):
+		case strings.HasPrefix(hash, "$2"):
+			fmt.Printf("Error in htpasswd line %d: bcrypt is not supported, use htpasswd -m\n", n)
+			os.Exit(1)
+		default:
+			fmt.Printf("Error in htpasswd line %d: unknown hash format for %s, use htpasswd -m or -s\n", n, user)
+			os.Exit(1)
+		}
+		proxyUsers[user] = hash
+	}
+	if err := scanner.Err(); err != nil {
+		fmt.Println("Error reading htpasswd:", err)
+		os.Exit(1)
+	}
+}
+
+// Parse the comma separated addresses and CIDRs allowed to use the listener
+func parseClients(list string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, c := range strings.Split(list, ",") {
+		c = strings.TrimSpace(c)
+		if !strings.Contains(c, "/") {
+			ip := net.ParseIP(c)
+			if ip == nil {
+				return nil, errors.New("invalid address " + c)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// Decide whether a client may use the listener by its source address
+func clientAllowed(addr net.Addr) bool {
+	if proxyClients == nil {
+		return true
+	}
+	tcp, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, n := range proxyClients {
+		if n.Contains(tcp.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// Check a user name and password against the htpasswd file
+func checkLogin(user, pass string) bool {
+	hash, ok := proxyUsers[user]
+	if !ok {
+		return false
+	}
+	var got string
+	switch {
+	case strings.HasPrefix(hash, "$apr1$"):
+		salt, _, _ := strings.Cut(hash[len("$apr1$"):], "$")
+		got = apr1(pass, salt)
+	case strings.HasPrefix(hash, "{SHA}"):
+		sum := sha1.Sum([]byte(pass))
+		got = "{SHA}" + base64.StdEncoding.EncodeToString(sum[:])
+	case strings.HasPrefix(hash, "{PLAIN}"):
+		got = "{PLAIN}" + pass
+	default:
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(got), []byte(hash)) == 1
+}
+
+// Check the value of a Proxy-Authorization header, which must be Basic
+func checkBasic(auth string) bool {
+	scheme, cred, ok := strings.Cut(auth, " ")
+	if !ok || !strings.EqualFold(scheme, "Basic") {
+		return false
+	}
+	b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(cred))
+	if err != nil {
+		return false
+	}
+	user, pass, ok := strings.Cut(string(b), ":")
+	return ok && checkLogin(user, pass)
+}
+
+// The Apache MD5 crypt of a password with the given salt
+func apr1(pass, salt string) string {
+	const magic = "$apr1$"
+	const itoa64 = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+	if len(salt) > 8 {
+		salt = salt[:8]
+	}
+	pw := []byte(pass)
+
+	alt := md5.Sum([]byte(pass + salt + pass))
+	h := md5.New()
+	h.Write([]byte(pass + magic + salt))
+	for i := len(pw); i > 0; i -= 16 {
+		if i > 16 {
+			h.Write(alt[:])
+		} else {
+			h.Write(alt[:i])
+		}
+	}
+	for i := len(pw); i > 0; i >>= 1 {
+		if i&1 != 0 {
+			h.Write([]byte{0})
+		} else {
+			h.Write(pw[:1])
+		}
+	}
+	final := h.Sum(nil)
+
+	// Stretch it out
+	for i := 0; i < 1000; i++ {
+		h := md5.New()
+		if i&1 != 0 {
+			h.Write(pw)
+		} else {
+			h.Write(final)
+		}
+		if i%3 != 0 {
+			h.Write([]byte(salt))
+		}
+		if i%7 != 0 {
+			h.Write(pw)
+		}
+		if i&1 != 0 {
+			h.Write(final)
+		} else {
+			h.Write(pw)
+		}
+		final = h.Sum(nil)
+	}
+
+	out := []byte(magic + salt + "$")
+	encode := func(v uint, n int) {
+		for ; n > 0; n-- {
+			out = append(out, itoa64[v&0x3f])
+			v >>= 6
+		}
+	}
+	for _, g := range [][3]int{{0, 6, 12}, {1, 7, 13}, {2, 8, 14}, {3, 9, 15}, {4, 10, 5}} {
+		encode(uint(final[g[0]])<<16|uint(final[g[1]])<<8|uint(final[g[2]]), 4)
+	}
+	encode(uint(final[11]), 2)
+	return string(out)
+}
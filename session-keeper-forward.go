@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Parse a [bind:]port=host:port forward, a bare port is bound to localhost
+func parseForward(fwd string) (local, dest string, err error) {
+	local, dest, ok := strings.Cut(fwd, "=")
+	if !ok {
+		return "", "", fmt.Errorf("Missing = in %q", fwd)
+	}
+	if !strings.Contains(local, ":") {
+		local = "localhost:" + local
+	}
+	if _, _, err = net.SplitHostPort(local); err != nil {
+		return
+	}
+	_, _, err = net.SplitHostPort(dest)
+	return
+}
+
+// Open a plain listener for each forward, every connection accepted is carried
+// to the fixed destination through a session
+func startForwards(forwards []string) {
+	for _, fwd := range forwards {
+		local, dest, err := parseForward(fwd)
+		if err != nil {
+			fmt.Println("Error parsing forward:", err)
+			os.Exit(1)
+		}
+		l, err := net.Listen("tcp", local)
+		if err != nil {
+			fmt.Println("Error listening:", err.Error())
+			os.Exit(1)
+		}
+		fmt.Println("Forwarding " + local + " to " + dest)
+		go func(l net.Listener, dest string) {
+			for {
+				conn, err := l.Accept()
+				if err != nil {
+					log.Println("Error accepting forward:", err.Error())
+					return
+				}
+				if !clientAllowed(conn.RemoteAddr()) {
+					log.Println("Refused forward from", conn.RemoteAddr())
+					conn.Close()
+					continue
+				}
+				if *verbose {
+					log.Println("Incoming connection", conn.RemoteAddr(), "forwarding to", dest)
+				}
+				go keepSession(conn, &proxyRequest{proto: proxyRaw, hostport: dest})
+			}
+		}(l, dest)
+	}
+}
+
+// Keep a control session for each reverse tunnel, over which the server
+// announces the connections it accepts
+func startReverses(reverses []string) {
+	for _, rev := range reverses {
+		remote, dest, err := parseForward(rev)
+		if err != nil {
+			fmt.Println("Error parsing reverse:", err)
+			os.Exit(1)
+		}
+		fmt.Println("Reverse forwarding server " + remote + " to " + dest)
+		go func(remote, dest string) {
+			for {
+				local, control := net.Pipe()
+				go readAnnouncements(control, dest)
+				err := keepSession(local, &proxyRequest{proto: proxyRaw, hostport: remote, listen: true})
+				if err != nil {
+					log.Println("Could not open reverse tunnel on", remote, err)
+				} else if *verbose {
+					log.Println("Reverse tunnel control session ended for", remote)
+				}
+				time.Sleep(3 * time.Second)
+			}
+		}(remote, dest)
+	}
+}
+
+// Read the id and secret of each new connection on a reverse tunnel, and
+// attach it to the local destination
+func readAnnouncements(control net.Conn, dest string) {
+	defer control.Close()
+	for {
+		var msg [16 + secretSize]byte
+		if _, err := io.ReadFull(control, msg[:]); err != nil {
+			return
+		}
+		var id uuid.UUID
+		copy(id[:], msg[:16])
+		go attachReverse(id, msg[16:], dest)
+	}
+}
+
+// Connect a reverse tunnel connection to the local destination
+func attachReverse(id uuid.UUID, secret []byte, dest string) {
+	if *verbose {
+		log.Println("Reverse connection", id.String(), "to", dest)
+	}
+	conn, err := net.Dial("tcp", dest)
+	if err != nil {
+		log.Println("Could not dial reverse destination:", dest, err)
+		// Let the server drop the connection it accepted
+		closeSession("", id, 0, 1, &secret)
+		return
+	}
+	keepSession(conn, &proxyRequest{proto: proxyRaw, hostport: dest, id: id, secret: secret})
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// Kinds of proxy request understood on the listener
+const (
+	proxyHTTP   = iota // HTTP CONNECT
+	proxySOCKS4        // SOCKS4 and SOCKS4a
+	proxySOCKS5        // SOCKS5 with no auth or username/password
+	proxyRaw           // no proxy handshake, the destination is fixed
+)
+
+// A request for a tunnel made by a local client
+type proxyRequest struct {
+	proto    int
+	hostport string
+
+	// For reverse tunnels, listen asks the server to listen on hostport and
+	// announce connections, which are attached to by their id and secret
+	listen bool
+	id     uuid.UUID
+	secret []byte
+}
+
+// Read the request from a new client, working out which proxy protocol it
+// speaks from the first byte
+func readProxyRequest(conn net.Conn) (*proxyRequest, error) {
+	var first [1]byte
+	if _, err := io.ReadFull(conn, first[:]); err != nil {
+		return nil, err
+	}
+	switch first[0] {
+	case 4:
+		return readSOCKS4(conn)
+	case 5:
+		return readSOCKS5(conn)
+	}
+	return readHTTPConnect(conn, io.MultiReader(bytes.NewReader(first[:]), conn))
+}
+
+// Parse the headers of an HTTP CONNECT request, refusing clients which are
+// not allowed or have not given a valid login
+func readHTTPConnect(conn net.Conn, r io.Reader) (*proxyRequest, error) {
+	req := &proxyRequest{proto: proxyHTTP}
+	var auth string
+	for i := 0; i < 100; i++ { // parse first 100 lines and give up
+		line, err := ReadLine(r, '\n')
+		if err != nil {
+			return nil, err
+		}
+		if strings.HasPrefix(line, "CONNECT ") && strings.HasSuffix(line, " HTTP/1.1") {
+			// when the CONNECT line is found, consume it
+			req.hostport = line[8 : len(line)-9]
+			if _, _, err = net.SplitHostPort(req.hostport); err != nil {
+				// Invalid host:port, give up early
+				return nil, err
+			}
+		} else if name, value, ok := strings.Cut(line, ":"); ok && strings.EqualFold(name, "Proxy-Authorization") {
+			auth = strings.TrimSpace(value)
+		} else if line == "" {
+			break
+		}
+	}
+	if req.hostport == "" {
+		return nil, errors.New("No CONNECT line found")
+	}
+	if !clientAllowed(conn.RemoteAddr()) {
+		writeHTTPStatus(conn, "403 Forbidden", "This address may not use the proxy")
+		return nil, errors.New("Client address not allowed")
+	}
+	if proxyUsers != nil && !checkBasic(auth) {
+		writeHTTPStatus(conn, "407 Proxy Authentication Required", "A proxy login is required",
+			"Proxy-Authenticate: Basic realm=\"session-keeper\"")
+		if auth == "" {
+			return nil, errors.New("No proxy login given")
+		}
+		return nil, errors.New("Bad proxy login")
+	}
+	return req, nil
+}
+
+// Answer an HTTP client with a status line, any extra headers and a plain
+// text body explaining it, closing the connection after
+func writeHTTPStatus(conn net.Conn, status, body string, headers ...string) error {
+	body += "\n"
+	msg := "HTTP/1.1 " + status + "\r\n"
+	for _, h := range headers {
+		msg += h + "\r\n"
+	}
+	msg += "Content-Type: text/plain; charset=utf-8\r\n" +
+		"Content-Length: " + strconv.Itoa(len(body)) + "\r\n" +
+		"Connection: close\r\n\r\n"
+	_, err := conn.Write([]byte(msg + body))
+	return err
+}
+
+// Parse a SOCKS4 or SOCKS4a request, the version byte has been read
+func readSOCKS4(conn net.Conn) (*proxyRequest, error) {
+	var hdr [7]byte // command, port, ip
+	if _, err := io.ReadFull(conn, hdr[:]); err != nil {
+		return nil, err
+	}
+	req := &proxyRequest{proto: proxySOCKS4}
+	if !clientAllowed(conn.RemoteAddr()) || proxyUsers != nil {
+		// SOCKS4 has no way to give a password
+		req.failed(conn, nil)
+		return nil, errors.New("SOCKS4 client not allowed")
+	}
+	if hdr[0] != 1 {
+		req.failed(conn, nil)
+		return nil, fmt.Errorf("Unsupported SOCKS4 command %d", hdr[0])
+	}
+	if _, err := readNul(conn); err != nil { // user id, unused
+		return nil, err
+	}
+	host := net.IP(hdr[3:7]).String()
+	if hdr[3] == 0 && hdr[4] == 0 && hdr[5] == 0 && hdr[6] != 0 {
+		// SOCKS4a, the host name follows
+		var err error
+		if host, err = readNul(conn); err != nil {
+			return nil, err
+		}
+	}
+	req.hostport = net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(hdr[1:3]))))
+	return req, nil
+}
+
+// Parse a SOCKS5 greeting and request, the version byte has been read
+func readSOCKS5(conn net.Conn) (*proxyRequest, error) {
+	var n [1]byte
+	if _, err := io.ReadFull(conn, n[:]); err != nil {
+		return nil, err
+	}
+	methods := make([]byte, n[0])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return nil, err
+	}
+	switch {
+	case !clientAllowed(conn.RemoteAddr()):
+		conn.Write([]byte{5, 0xff})
+		return nil, errors.New("SOCKS5 client address not allowed")
+	case proxyUsers == nil && bytes.IndexByte(methods, 0) >= 0:
+		// No authentication
+		if _, err := conn.Write([]byte{5, 0}); err != nil {
+			return nil, err
+		}
+	case bytes.IndexByte(methods, 2) >= 0:
+		// Username and password, RFC 1929
+		if _, err := conn.Write([]byte{5, 2}); err != nil {
+			return nil, err
+		}
+		user, pass, err := readSOCKS5Login(conn)
+		if err != nil {
+			return nil, err
+		}
+		if proxyUsers != nil && !checkLogin(user, pass) {
+			conn.Write([]byte{1, 1})
+			return nil, errors.New("Bad SOCKS5 login for " + user)
+		}
+		if _, err := conn.Write([]byte{1, 0}); err != nil {
+			return nil, err
+		}
+	default:
+		conn.Write([]byte{5, 0xff})
+		return nil, errors.New("No acceptable SOCKS5 auth method")
+	}
+
+	var hdr [4]byte // version, command, reserved, address type
+	if _, err := io.ReadFull(conn, hdr[:]); err != nil {
+		return nil, err
+	}
+	req := &proxyRequest{proto: proxySOCKS5}
+	var host string
+	switch hdr[3] {
+	case 1, 4: // IPv4 or IPv6
+		ip := make([]byte, 4)
+		if hdr[3] == 4 {
+			ip = make([]byte, 16)
+		}
+		if _, err := io.ReadFull(conn, ip); err != nil {
+			return nil, err
+		}
+		host = net.IP(ip).String()
+	case 3: // domain name
+		if _, err := io.ReadFull(conn, n[:]); err != nil {
+			return nil, err
+		}
+		name := make([]byte, n[0])
+		if _, err := io.ReadFull(conn, name); err != nil {
+			return nil, err
+		}
+		host = string(name)
+	default:
+		req.reply(conn, 8) // address type not supported
+		return nil, fmt.Errorf("Unsupported SOCKS5 address type %d", hdr[3])
+	}
+	var port [2]byte
+	if _, err := io.ReadFull(conn, port[:]); err != nil {
+		return nil, err
+	}
+	if hdr[0] != 5 || hdr[1] != 1 {
+		req.reply(conn, 7) // command not supported
+		return nil, fmt.Errorf("Unsupported SOCKS5 command %d", hdr[1])
+	}
+	req.hostport = net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port[:]))))
+	return req, nil
+}
+
+// Read the RFC 1929 username and password sub-negotiation
+func readSOCKS5Login(conn net.Conn) (user, pass string, err error) {
+	var b [2]byte // version, username length
+	if _, err = io.ReadFull(conn, b[:]); err != nil {
+		return
+	}
+	if b[0] != 1 {
+		conn.Write([]byte{1, 1})
+		err = fmt.Errorf("Unsupported SOCKS5 login version %d", b[0])
+		return
+	}
+	field := make([]byte, b[1])
+	if _, err = io.ReadFull(conn, field); err != nil {
+		return
+	}
+	user = string(field)
+	if _, err = io.ReadFull(conn, b[1:]); err != nil {
+		return
+	}
+	field = make([]byte, b[1])
+	if _, err = io.ReadFull(conn, field); err != nil {
+		return
+	}
+	return user, string(field), nil
+}
+
+// Read a NUL terminated string of at most 255 bytes
+func readNul(r io.Reader) (string, error) {
+	return ReadLine(io.LimitReader(r, 256), 0)
+}
+
+// Send a SOCKS5 reply with the given status
+func (r *proxyRequest) reply(conn net.Conn, status byte) error {
+	_, err := conn.Write([]byte{5, status, 0, 1, 0, 0, 0, 0, 0, 0})
+	return err
+}
+
+// Tell the client the tunnel is open
+func (r *proxyRequest) established(conn net.Conn) error {
+	var err error
+	switch r.proto {
+	case proxyHTTP:
+		_, err = conn.Write([]byte("HTTP/1.0 200 Connection Established\r\n" +
+			"Connection: close\r\n" +
+			"\r\n"))
+	case proxySOCKS4:
+		_, err = conn.Write([]byte{0, 0x5a, 0, 0, 0, 0, 0, 0})
+	case proxySOCKS5:
+		err = r.reply(conn, 0)
+	}
+	return err
+}
+
+// What a failure code from the server means for the client
+var failReasons = map[uint16]string{
+	failDenied:  "The destination is not allowed by the session-server policy",
+	failAuth:    "The session-server did not accept this keeper",
+	failDial:    "The destination could not be reached",
+	failResolve: "The destination name could not be resolved",
+	failRefused: "The destination refused the connection",
+	failTimeout: "The destination did not answer in time",
+}
+
+// Tell the client the tunnel could not be opened and why, as far as the
+// proxy protocol allows
+func (r *proxyRequest) failed(conn net.Conn, err error) {
+	var code uint16
+	var re *remoteError
+	if errors.As(err, &re) {
+		code = re.Code
+	}
+	switch r.proto {
+	case proxyHTTP:
+		body := "Could not open a session through the session-server"
+		if reason, ok := failReasons[code]; ok {
+			body = reason + ": " + re.Msg
+		} else if err != nil {
+			body += ": " + err.Error()
+		}
+		switch code {
+		case failDenied, failAuth:
+			writeHTTPStatus(conn, "403 Forbidden", body)
+		case failTimeout:
+			writeHTTPStatus(conn, "504 Gateway Timeout", body)
+		default:
+			writeHTTPStatus(conn, "502 Bad Gateway", body)
+		}
+	case proxySOCKS4:
+		conn.Write([]byte{0, 0x5b, 0, 0, 0, 0, 0, 0})
+	case proxySOCKS5:
+		switch code {
+		case failDenied, failAuth:
+			r.reply(conn, 2) // not allowed by ruleset
+		case failResolve, failTimeout:
+			r.reply(conn, 4) // host unreachable
+		case failRefused:
+			r.reply(conn, 5) // connection refused
+		default:
+			r.reply(conn, 1) // general failure
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"flag"
+	"log"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+var (
+	retryDelay  = flag.Duration("retry", time.Second, "Wait this long before the second reconnect attempt of an outage, the first is immediate")
+	retryMax    = flag.Duration("retrymax", time.Minute, "Longest wait between reconnect attempts")
+	retryFactor = flag.Float64("backoff", 2, "Multiply the wait by this much after each failed reconnect")
+	retryJitter = flag.Float64("jitter", 0.2, "Vary each wait randomly by up to this fraction, so keepers do not reconnect in step")
+	outageLimit = flag.Duration("outage", time.Hour, "Give up on a session which could not be reconnected for this long (0 for never)")
+)
+
+// A backoff paces the reconnects of a session through an outage, waiting
+// longer after each failure and giving up once the outage has gone on for too
+// long
+type backoff struct {
+	id    uuid.UUID
+	start time.Time // when the outage began, zero while connected
+	delay time.Duration
+}
+
+// The session is connected again, the next outage starts afresh
+func (b *backoff) reset() {
+	if b.delay > 0 {
+		log.Println("Session", b.id.String(), "reconnected after", time.Since(b.start).Round(time.Second))
+	}
+	b.start, b.delay = time.Time{}, 0
+}
+
+// Wait before the next reconnect, false once the outage has used up its time
+func (b *backoff) wait() bool {
+	now := time.Now()
+	if b.start.IsZero() {
+		// Try again straight away, the transport may just have been reset
+		b.start = now
+		return true
+	}
+	if b.delay == 0 {
+		b.delay = *retryDelay
+	} else if b.delay = time.Duration(float64(b.delay) * *retryFactor); b.delay > *retryMax {
+		b.delay = *retryMax
+	}
+	d := time.Duration(float64(b.delay) * (1 + *retryJitter*(2*random()-1)))
+	if *outageLimit > 0 {
+		left := *outageLimit - now.Sub(b.start)
+		if left <= 0 {
+			log.Println("Giving up on session", b.id.String(), "after an outage of", now.Sub(b.start).Round(time.Second))
+			return false
+		} else if d > left {
+			d = left
+		}
+		log.Println("Reconnecting session", b.id.String(), "in", d.Round(time.Millisecond), "with", left.Round(time.Second), "of the outage limit left")
+	} else {
+		log.Println("Reconnecting session", b.id.String(), "in", d.Round(time.Millisecond))
+	}
+	time.Sleep(d)
+	return true
+}
+
+// A random number in [0, 1)
+func random() float64 {
+	var b [8]byte
+	rand.Read(b[:])
+	return float64(binary.BigEndian.Uint64(b[:])>>11) / (1 << 53)
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"net"
+	"os"
+	"time"
+)
+
+// A stdioConn presents stdin and stdout as a connection so a session can be
+// kept for a single client such as an SSH ProxyCommand
+type stdioConn struct{}
+
+type stdioAddr struct{}
+
+func (stdioAddr) Network() string { return "stdio" }
+func (stdioAddr) String() string  { return "stdio" }
+
+func (stdioConn) Read(b []byte) (int, error)  { return os.Stdin.Read(b) }
+func (stdioConn) Write(b []byte) (int, error) { return os.Stdout.Write(b) }
+
+func (stdioConn) Close() error {
+	os.Stdin.Close()
+	return os.Stdout.Close()
+}
+
+func (stdioConn) LocalAddr() net.Addr                { return stdioAddr{} }
+func (stdioConn) RemoteAddr() net.Addr               { return stdioAddr{} }
+func (stdioConn) SetDeadline(t time.Time) error      { return nil }
+func (stdioConn) SetReadDeadline(t time.Time) error  { return nil }
+func (stdioConn) SetWriteDeadline(t time.Time) error { return nil }
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"flag"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+var cooldown = flag.Duration("cooldown", 30*time.Second, "Skip a session-server address for this long after it could not be reached")
+
+// How long to wait on a dial before trying the next address
+const dialTimeout = 10 * time.Second
+
+// One address of a session-server given with -target.  Several may reach the
+// same server, so the keeper remembers which server answered at each and when
+// one could last not be reached.
+type targetAddr struct {
+	addr, host string
+	server     string    // identity of the server last reached here, empty until then
+	failed     time.Time // skipped until the cooldown has passed
+	trunk      *muxConn  // the shared transport when multiplexing
+}
+
+var (
+	targets     []*targetAddr
+	targetMutex sync.Mutex
+)
+
+// Parse the comma separated list of session-server addresses
+func parseTargets(list string) ([]*targetAddr, error) {
+	var out []*targetAddr
+	for _, addr := range strings.Split(list, ",") {
+		addr = strings.TrimSpace(addr)
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, &targetAddr{addr: addr, host: host})
+	}
+	return out, nil
+}
+
+// The addresses worth trying for a session owned by the given server, or for
+// a new session when there is no owner yet.  Addresses known to reach another
+// server are left out, those cooling down after a failure are skipped while
+// any other is left and only tried when none is, and otherwise the order given
+// with -target is kept.
+func pickTargets(owner string, skip map[*targetAddr]bool) []*targetAddr {
+	targetMutex.Lock()
+	defer targetMutex.Unlock()
+	var healthy, cooling []*targetAddr
+	for _, t := range targets {
+		switch {
+		case skip[t]:
+		case owner != "" && t.server != "" && t.server != owner:
+		case time.Since(t.failed) < *cooldown:
+			cooling = append(cooling, t)
+		default:
+			healthy = append(healthy, t)
+		}
+	}
+	if len(healthy) == 0 {
+		return cooling
+	}
+	return healthy
+}
+
+// The address could not be reached
+func (t *targetAddr) fail() {
+	targetMutex.Lock()
+	t.failed = time.Now()
+	targetMutex.Unlock()
+}
+
+// A server answered at the address, with the identity it gave if any
+func (t *targetAddr) reached(server []byte) {
+	targetMutex.Lock()
+	t.failed = time.Time{}
+	if len(server) > 0 {
+		t.server = string(server)
+	}
+	targetMutex.Unlock()
+}
+
+// Open a transport, or a stream on a shared one when multiplexing, to the
+// first address which can be reached for the session owner
+func dialTarget(owner string, skip map[*targetAddr]bool) (net.Conn, *targetAddr, error) {
+	err := errors.New("No session-server address left to try")
+	for _, t := range pickTargets(owner, skip) {
+		if *verbose {
+			log.Println("Dialing", t.addr)
+		}
+		var conn net.Conn
+		if *useMux {
+			conn, err = dialStream(t)
+		} else {
+			conn, err = dialTransport(t)
+		}
+		if err == nil {
+			return conn, t, nil
+		}
+		if *verbose {
+			log.Println("Could not reach", t.addr, err)
+		}
+		t.fail()
+	}
+	return nil, nil, err
+}
+
+func dialTransport(t *targetAddr) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: dialTimeout}
+	if tlsConfig != nil {
+		cfg := tlsConfig.Clone()
+		cfg.ServerName = t.host
+		return tls.DialWithDialer(dialer, "tcp", t.addr, cfg)
+	}
+	return dialer.Dial("tcp", t.addr)
+}
+
+// Send a close for a session with a resume epoch later than any used for it,
+// moving on to the next address while the servers answering do not know it
+func closeSession(owner string, id uuid.UUID, offset int64, epoch uint64, secret *[]byte) {
+	skip := make(map[*targetAddr]bool)
+	for {
+		dstConn, t, err := dialTarget(owner, skip)
+		if err != nil {
+			return
+		}
+		// A server which accepts and then stalls is not waited on for ever
+		dstConn.SetDeadline(time.Now().Add(handshakeWait(hdrClose)))
+		rcvHdr, _, err := handshake(dstConn, newHeader(hdrClose, id, offset),
+			map[byte][]byte{optEpoch: epochOpt(epoch)}, secret)
+		if err == nil && rcvHdr.Kind == hdrError {
+			err = readError(dstConn)
+		}
+		dstConn.Close()
+		if re, ok := err.(*remoteError); !ok || re.Code != failUnknown {
+			// kind of doesn't matter if the error happens, as, well, we tried!
+			return
+		}
+		skip[t] = true
+	}
+}
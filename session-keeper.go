@@ -15,8 +15,9 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
-	"encoding/binary"
+	"crypto/tls"
 	"errors"
 	"flag"
 	"fmt"
@@ -24,21 +25,48 @@ import (
 	"log"
 	"net"
 	"os"
-	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/google/uuid"
 )
 
 var (
-	listen  = flag.String("listen", ":2222", "Where to listen to incoming connections (example 1.2.3.4:8080)")
-	target  = flag.String("target", "localhost:2020", "Remote SSHProxy to connect to")
-	verbose = flag.Bool("verbose", false, "Turn on verbosity")
-	version string
+	listen     = flag.String("listen", ":2222", "Where to listen to incoming connections (example 1.2.3.4:8080)")
+	target     = flag.String("target", "localhost:2020", "Remote SSHProxy to connect to, or a comma separated list of addresses to fail over between")
+	verbose    = flag.Bool("verbose", false, "Turn on verbosity")
+	useTLS     = flag.Bool("tls", false, "Connect to the session-server over TLS")
+	caFile     = flag.String("ca", "", "Verify the session-server certificate against this CA (PEM)")
+	pin        = flag.String("pin", "", "Accept only a session-server with this SHA-256 public key fingerprint (hex or sha256//base64)")
+	certFile   = flag.String("cert", "", "TLS client certificate file for mutual TLS (PEM)")
+	keyFile    = flag.String("key", "", "TLS client key file for mutual TLS (PEM)")
+	useMux     = flag.Bool("mux", false, "Carry all sessions as streams over one shared transport to the session-server")
+	stdio      = flag.String("stdio", "", "Carry stdin/stdout to this host:port instead of listening, for use as an SSH ProxyCommand")
+	spillDir   = flag.String("spill", "", "Directory to hold session buffers past the -buffer size on disk (memory only by default)")
+	pingEvery  = flag.Duration("ping", 5*time.Second, "Ping the session-server this often to notice a dead transport (0 for never)")
+	pingMisses = flag.Int("misses", 3, "Reconnect after this many ping intervals with nothing heard from the session-server")
+	tokenFile  = flag.String("token", "", "File holding a pre-shared token which identifies this keeper to the session-server")
+	htpasswd   = flag.String("htpasswd", "", "Require clients of the proxy listener to log in as a user of this htpasswd file")
+	clients    = flag.String("clients", "", "Comma separated addresses or CIDRs allowed to use the listeners (all by default)")
+	version    string
+
+	forwards   listFlag
+	reverses   listFlag
+	bufferSize sizeFlag = 64 << 20
+	spillLimit sizeFlag
+	tlsConfig  *tls.Config
+	token      []byte
+
+	// Held while dialing a shared transport when multiplexing
+	trunkMutex sync.Mutex
 )
 
 func main() {
+	flag.Var(&forwards, "forward", "Forward a plain local [bind:]port=host:port through a session, may be repeated")
+	flag.Var(&reverses, "reverse", "Listen on the server side [bind:]port and carry connections back to host:port, may be repeated")
+	flag.Var(&bufferSize, "buffer", "Most bytes held for a session before reading from the client waits (K, M or G suffix, 0 for no limit)")
+	flag.Var(&spillLimit, "spillmax", "Most bytes held on disk for a session before reading from the client waits (K, M or G suffix, 0 for no limit)")
 	flag.Usage = func() {
 		fmt.Fprintf(os.Stderr, "Session-Keeper (github.com/pschou/session-keeper, version: %s)\n\nUsage: %s [options]\n",
 			version, os.Args[0])
@@ -52,7 +80,58 @@ func main() {
 		os.Exit(1)
 	}
 
+	var err error
+	if targets, err = parseTargets(*target); err != nil {
+		fmt.Fprintln(os.Stderr, "Error parsing target:", err)
+		os.Exit(1)
+	}
+	if *useTLS {
+		tlsConfig = keeperTLSConfig()
+	}
+	if *tokenFile != "" {
+		b, err := os.ReadFile(*tokenFile)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error reading token:", err)
+			os.Exit(1)
+		}
+		token = bytes.TrimSpace(b)
+	}
+	if *htpasswd != "" {
+		loadHtpasswd(*htpasswd)
+	}
+	if *clients != "" {
+		if proxyClients, err = parseClients(*clients); err != nil {
+			fmt.Fprintln(os.Stderr, "Error parsing clients:", err)
+			os.Exit(1)
+		}
+	}
+	if *spillDir != "" {
+		if err := sweepSpill(*spillDir); err != nil {
+			fmt.Fprintln(os.Stderr, "Error preparing spill directory:", err)
+			os.Exit(1)
+		}
+	}
+
+	if *stdio != "" {
+		// A single session over stdin/stdout, stdout is for data only
+		if _, _, err := net.SplitHostPort(*stdio); err != nil {
+			fmt.Fprintln(os.Stderr, "Error parsing stdio destination:", err)
+			os.Exit(1)
+		}
+		if err := keepSession(stdioConn{}, &proxyRequest{proto: proxyRaw, hostport: *stdio}); err != nil {
+			fmt.Fprintln(os.Stderr, "Error connecting to", *stdio, err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	postSetup()
+	startForwards(forwards)
+	startReverses(reverses)
+	if *listen == "" {
+		// Only the forwards are wanted
+		select {}
+	}
 
 	// Listen for incoming connections.
 	l, err := net.Listen("tcp", *listen)
@@ -75,108 +154,175 @@ func main() {
 	}
 }
 
-// Handle a new client connection with retrying and re-establishing the
-// outgoing connection when a TCP outbound connection is lost.
+// Build the TLS settings from the flags, exiting when they are unusable
+func keeperTLSConfig() *tls.Config {
+	// The server name is filled in for each target address when dialing
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	var err error
+	if cfg.Certificates, err = loadKeyPair(*certFile, *keyFile); err != nil {
+		fmt.Println("Error loading TLS client certificate:", err)
+		os.Exit(1)
+	}
+	if *caFile != "" {
+		if cfg.RootCAs, err = loadCertPool(*caFile); err != nil {
+			fmt.Println("Error loading TLS CA:", err)
+			os.Exit(1)
+		}
+	}
+	if *pin != "" {
+		fp, err := parsePin(*pin)
+		if err != nil {
+			fmt.Println("Error parsing pin:", err)
+			os.Exit(1)
+		}
+		// The pin replaces the usual chain check, which is still done if a CA is given
+		cfg.InsecureSkipVerify = true
+		cfg.VerifyConnection = verifyPinned(fp, cfg.RootCAs)
+	}
+	return cfg
+}
+
+// Open a stream on the shared transport to an address, dialing it first if
+// it has gone, so after an outage one reconnect brings back every session
+func dialStream(t *targetAddr) (net.Conn, error) {
+	trunkMutex.Lock()
+	defer trunkMutex.Unlock()
+	if t.trunk == nil || t.trunk.Closed() {
+		if *verbose {
+			log.Println("Dialing shared transport", t.addr)
+		}
+		conn, err := dialTransport(t)
+		if err != nil {
+			return nil, err
+		}
+		conn.SetDeadline(time.Now().Add(10 * time.Second))
+		rcvHdr, _, err := handshake(conn, newHeader(hdrMux, uuid.New(), 0), nil, nil)
+		if err == nil && rcvHdr.Kind == hdrError {
+			err = readError(conn)
+		} else if err == nil && (rcvHdr.Kind != hdrEstablished || rcvHdr.Caps&capMux == 0) {
+			err = errors.New("Server does not support multiplexing")
+		}
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn.SetDeadline(time.Time{})
+		t.trunk = newMux(conn, true, newHeartbeat(*pingEvery, *pingMisses))
+	}
+	return t.trunk.Open()
+}
+
+// Handle a new client connection, reading the proxy request and carrying it
+// through a session
 func handleRequest(conn net.Conn) {
 	if *verbose {
 		log.Println("Incoming connection", conn.RemoteAddr())
 	}
 
-	var dstConn net.Conn
-	var remoteClose bool
-	hdr := ConnHeader{UUID: uuid.New(), Offset: -1}
+	// Parse the initial proxy connection
+	req, err := readProxyRequest(conn)
+	if err != nil {
+		if *verbose {
+			log.Println("Bad proxy request", err)
+		}
+		conn.Close()
+		return
+	}
+	if *verbose {
+		log.Println("Got CONNECT to", req.hostport)
+	}
+	keepSession(conn, req)
+}
+
+// Carry a client connection to the requested destination with retrying and
+// re-establishing the outgoing connection when a TCP outbound connection is
+// lost.  An error is returned when the session could not be opened at all.
+func keepSession(conn net.Conn, req *proxyRequest) (err error) {
+	var state lifecycle
+	var secret []byte
+	var epoch uint64 // resumes made, so the server can fence off older transports
+	hostport := req.hostport
+	hdr := newHeader(hdrNew, uuid.New(), 0)
+	if req.secret != nil {
+		// Attach to a session the server opened
+		hdr = newHeader(hdrResume, req.id, 0)
+		secret = req.secret
+	}
+
+	// Go ahead and start reading into a buffer from the local connection
+	buf := replayBuffer{limit: int(bufferSize), spill: newSpill(*spillDir, int64(spillLimit))}
+	wake := newWakeup()
+
+	// The server holding the session, and the addresses found not to know it
+	var owner string
+	skip := make(map[*targetAddr]bool)
 
 	// Make sure all the time we have sent (or tried to send) an EOF signal.
 	defer func() {
 		conn.Close()
-		if !remoteClose && dstConn != nil {
+		buf.Free()
+		if state.get() != stateClosed && hdr.Kind != hdrNew {
 			if *verbose {
 				log.Println("sending EOF signal")
 			}
-			if dstConn, err := net.Dial("tcp", *target); err == nil {
-				EOFhdr := ConnHeader{UUID: hdr.UUID, Offset: -3}
-				// Write out an EOF packet to a new connection to terminate the stream
-				binary.Write(dstConn, binary.BigEndian, EOFhdr)
-				// kind of doesn't matter if the error happens, as, well, we tried!
-				dstConn.Close()
-			}
+			// Write out an EOF header to a new connection to terminate the stream
+			closeSession(owner, hdr.UUID, hdr.Offset, epoch+1, &secret)
 		}
 	}()
 
-	// Parse the initial proxy connection
-	var hostport string
-	for i := 0; i < 100; i++ { // parse first 100 lines and give up
-		line, err := ReadLine(conn, '\n')
-		if err != nil {
-			return
-		}
-		if strings.HasPrefix(line, "CONNECT ") && strings.HasSuffix(line, " HTTP/1.1") {
-			// when the CONNECT line is found, consume it
-			hostport = line[8 : len(line)-9]
-			_, _, err = net.SplitHostPort(hostport)
-			if err != nil {
-				// Invalid host:port, give up early
-				return
-			}
-		} else if line == "" {
-			break
-		}
-	}
-	if hostport == "" {
-		// no CONNECT line was found, or it was empty
-		return
-	}
-	if *verbose {
-		log.Println("Got CONNECT to", hostport)
-	}
-
-	// Go ahead and start reading into a buffer from the local connection
-	var buf bytes.Buffer
-	var bufMutex sync.Mutex
-	var bufOffset int64
-	var closeLocal bool
-	var C = make(chan bool, 3)
-
 	// Do the work of the read from local
 	go func() {
-		readBuf := make([]byte, 10002)
-		for !closeLocal {
-			n, err := conn.Read(readBuf[2:])
+		readBuf := make([]byte, 10000)
+		for !state.ending() {
+			n, err := conn.Read(readBuf)
 			if err != nil {
-				closeLocal = true
+				state.to(stateClosing)
 			}
-			readBuf[0], readBuf[1] = byte(n>>8), byte(n&0xff)
-			bufMutex.Lock()
-			buf.Write(readBuf[:n+2])
-			bufMutex.Unlock()
-			if len(C) == 0 {
-				C <- true
+			// Waits while the buffer is full, holding back the client
+			if _, err := buf.Write(readBuf[:n]); err != nil {
+				state.to(stateClosing)
 			}
+			wake.notify()
 		}
-		conn.Close()
-		if dstConn != nil {
-			dstConn.Close()
-		}
-		close(C)
 	}()
 
-	// Establish an outgoing connection with a retry counter
-	var err error
-	for i := 0; i < 100 && err == nil && !closeLocal; i++ { // 100 retries
-		if *verbose && hdr.Offset >= 0 {
-			log.Println("reconnecting  hoff:", hdr.Offset)
+	// Establish an outgoing connection, pacing the retries through an outage.
+	// The outage limit is for sessions which were established, opening one
+	// is only tried a few times before the client is told it failed.
+	retry := backoff{id: hdr.UUID}
+	var again bool
+	var attempts int
+	var newErr error // why the last try at opening the session failed
+	for err == nil && state.get() != stateClosed {
+		if hdr.Kind == hdrNew && attempts > 0 {
+			if state.ending() {
+				err = errors.New("Client went away before the session was opened")
+				break
+			} else if attempts >= newAttempts {
+				err = newErr
+				break
+			}
+		}
+		attempts++
+		if !again && !retry.wait() {
+			err = errors.New("Outage limit reached")
+			break
+		}
+		again = false
+		if hdr.Kind == hdrResume {
+			state.to(stateResuming)
+			if *verbose {
+				log.Println("reconnecting  hoff:", hdr.Offset)
+			}
 		}
 
 		// Thread to handle the outgoing connection
 		err = func() error {
-			if *verbose {
-				log.Println("Dialing ", *target)
-			}
-			if dstConn, err = net.Dial("tcp", *target); err != nil {
-				if hdr.Offset == -1 {
-					return net.ErrClosed // On first connection, give up early
+			dstConn, t, err := dialTarget(owner, skip)
+			if err != nil {
+				if hdr.Kind == hdrNew {
+					return err // On first connection, give up early
 				}
-				time.Sleep(time.Second * 3)
 				return nil // Cannot connect to endpoint, go back and loop
 			}
 
@@ -186,34 +332,48 @@ func handleRequest(conn net.Conn) {
 			if *verbose {
 				log.Println("Writing header", hdr.UUID.String())
 			}
-			if err = binary.Write(dstConn, binary.BigEndian, hdr); err != nil {
-				return fmt.Errorf("Could not write to connection: %s", err)
+			var opts map[byte][]byte
+			if hdr.Kind == hdrNew && req.listen {
+				// This is a new reverse tunnel, tell the server where to listen
+				opts = map[byte][]byte{optListen: []byte(hostport)}
+			} else if hdr.Kind == hdrNew {
+				// This is a new connection, tell the server where to connect
+				opts = map[byte][]byte{optDest: []byte(hostport)}
 			}
-
-			if hdr.Offset == -1 {
-				// This is a new connection
-				fmt.Fprintf(dstConn, "%s\n", hostport) // write out the connect header
+			if hdr.Kind == hdrNew && len(token) > 0 {
+				opts[optToken] = token
+			} else if hdr.Kind == hdrResume {
+				// Later than any transport before, should one still be hanging on
+				epoch++
+				opts = map[byte][]byte{optEpoch: epochOpt(epoch)}
 			}
 
 			// Now read back the remote header
 			var rcvHdr ConnHeader
+			var rcvOpts map[byte][]byte
 			if *verbose {
 				log.Println("Reading header", hdr.UUID.String())
 			}
 
-			go func() {
-				// kill function for fast reconnects
-				time.Sleep(3 * time.Second)
-				if !bytes.Equal(rcvHdr.UUID[:], hdr.UUID[:]) {
-					dstConn.Close()
+			// kill function for fast reconnects
+			kill := time.AfterFunc(handshakeWait(hdr.Kind), func() { dstConn.Close() })
+			rcvHdr, rcvOpts, err = handshake(dstConn, hdr, opts, &secret)
+			timedOut := !kill.Stop()
+			if err == errBadMagic || err == nil && rcvHdr.Version < protoMinVersion {
+				return fmt.Errorf("Server does not speak protocol version %d", protoVersion)
+			} else if err != nil {
+				t.fail()
+				if hdr.Kind == hdrNew && timedOut {
+					// The server has had long enough to report on the destination,
+					// it is stuck so give up on the session now
+					return fmt.Errorf("No answer from the session-server within %s", handshakeWait(hdr.Kind))
 				}
-			}()
-
-			err = binary.Read(dstConn, binary.BigEndian, &rcvHdr)
-			if err != nil {
-				time.Sleep(time.Second * 3)
+				// A new session is asked for again under the same id, the server
+				// drops any first try whose reply was lost in favour of it
+				newErr = err
 				return nil
 			}
+			t.reached(rcvOpts[optServer])
 
 			if *verbose {
 				log.Println("Got header", rcvHdr)
@@ -224,112 +384,253 @@ func handleRequest(conn net.Conn) {
 				return errors.New("UUID does not match")
 			}
 
-			// Close the connection when there is a remote EOF signal
-			if rcvHdr.Offset == -4 {
-				remoteClose = true
+			switch rcvHdr.Kind {
+			case hdrClosed:
+				// Close the connection when there is a remote EOF signal
+				state.to(stateClosed)
 				conn.Close()
 				return io.EOF
+			case hdrError:
+				err := readError(dstConn)
+				if re, ok := err.(*remoteError); ok && re.Code == failStale {
+					// An attempt given up on reached the server after all, go again past it
+					return nil
+				} else if ok && re.Code == failUnknown && hdr.Kind == hdrResume {
+					// A server other than the owner, go straight on to the next address
+					skip[t] = true
+					if len(pickTargets(owner, skip)) > 0 {
+						again = true
+						return nil
+					}
+				}
+				// The server refused, no point in trying again
+				state.to(stateClosed)
+				return err
+			case hdrEstablished:
+			default:
+				return fmt.Errorf("Unexpected header kind %d", rcvHdr.Kind)
 			}
 
 			// Compare that both are at the start
-			if hdr.Offset == -1 {
-				if rcvHdr.Offset != -2 {
+			if hdr.Kind == hdrNew {
+				if rcvHdr.Offset != 0 {
 					return errors.New("New session not established")
 				}
+				if secret = rcvOpts[optSecret]; len(secret) == 0 {
+					return errors.New("Server did not hand over a session secret")
+				}
 				if *verbose {
 					log.Println("Session established")
 				}
-				hdr.Offset, rcvHdr.Offset = 0, 0
-				conn.Write([]byte("HTTP/1.0 200 Connection Established\r\n" +
-					"Connection: close\r\n" +
-					"\r\n"))
+				hdr.Kind = hdrResume
+				req.established(conn)
 			}
 
-			if rcvHdr.Offset < bufOffset || rcvHdr.Offset > bufOffset+int64(buf.Len()) {
-				return errors.New("Buffer failed to maintain state")
+			// Drop what the remote already has and send the rest again
+			if err = buf.Rewind(rcvHdr.Offset); err != nil {
+				return fmt.Errorf("Buffer failed to maintain state: %s", err)
 			}
 
 			// We're in a good state
-			i = 0 // Restart the counter as we connected and established a session
-
-			// Advance the local buffer if we need to
-			for rcvHdr.Offset > bufOffset {
-				bufMutex.Lock()
-				sz := buf.Next(2)
-				tosend := buf.Next(int(sz[0])<<8 + int(sz[1]))
-				bufOffset += int64(len(tosend))
-				bufMutex.Unlock()
+			retry.reset()
+			if owner == "" {
+				owner = string(rcvOpts[optServer])
+			}
+			skip = make(map[*targetAddr]bool)
+
+			// Pings keep the transport busy so one which has gone quiet is
+			// noticed and reconnected within seconds
+			interval := *pingEvery
+			if rcvHdr.Caps&capPing == 0 || *useMux {
+				// Streams of a multiplexed transport are left to its own
+				// keepalive, so an idle one sends nothing
+				interval = 0
 			}
+			hb := newHeartbeat(interval, *pingMisses)
 
-			// Do the work of the read from remote and printing locally
+			state.to(stateEstablished)
+
+			// Do the work of the read from remote and printing locally.  The
+			// transport is not let go of until the reads have stopped, so two
+			// transports never both write to the client.
 			var localErr error
-			var close bool
+			var dropped int32 // set once the transport is done with
+			closed := func() bool { return atomic.LoadInt32(&dropped) != 0 }
+			var reading sync.WaitGroup
+			reading.Add(1)
+			defer func() {
+				dstConn.Close()
+				reading.Wait()
+			}()
 			go func() { // Create thread for reading with close
 				defer func() {
-					close = true
-					C <- true
+					atomic.StoreInt32(&dropped, 1)
+					wake.notify()
+					reading.Done()
 				}()
 
-				rcvBuf := make([]byte, 1<<10)
-				for !close && !closeLocal { // infinite loop reading from DST
-					n, err := dstConn.Read(rcvBuf)
-					if close || err != nil {
+				r := bufio.NewReader(dstConn)
+				for !closed() { // infinite loop reading frames from DST
+					dstConn.SetReadDeadline(hb.deadline())
+					typ, payload, err := readFrame(r)
+					if !closed() && errors.Is(err, os.ErrDeadlineExceeded) {
+						// Nothing heard, let go of the transport so a stuck write gives up too
+						if *verbose {
+							log.Println("Transport timed out", hdr.UUID.String())
+						}
+						dstConn.Close()
+					}
+					if closed() || err != nil {
 						return
 					}
-					tosend := rcvBuf[:n]
-					for len(tosend) > 0 {
+					switch typ {
+					case frameData:
 						if *verbose {
-							fmt.Printf("fromDST %q  hoff: %d\n", tosend, hdr.Offset)
+							log.Printf("fromDST %q  hoff: %d", payload, atomic.LoadInt64(&hdr.Offset))
 						}
-						wn, writeErr := conn.Write(tosend)
-						hdr.Offset += int64(wn)
+						wn, writeErr := conn.Write(payload)
+						atomic.AddInt64(&hdr.Offset, int64(wn))
 						if writeErr != nil {
 							localErr = writeErr
-							closeLocal = true
+							state.to(stateClosing)
+							return
+						}
+						// Let the writer see an acknowledgement is owed
+						wake.notify()
+					case frameAck:
+						off, err := parseAck(payload)
+						if err == nil {
+							err = buf.Ack(off)
+						}
+						if err != nil {
+							localErr = fmt.Errorf("Bad acknowledgement: %s", err)
+							writeError(dstConn, failBuffer, err.Error())
 							return
 						}
-						tosend = tosend[wn:]
+						if state.ending() {
+							// The writer may be waiting on the last of it to close
+							wake.notify()
+						}
+					case framePing:
+						writeFrame(dstConn, framePong, payload)
+					case frameClose:
+						// The server end has closed and everything has been delivered
+						if *verbose {
+							log.Println("Got an EOF signal from remote")
+						}
+						state.to(stateClosed)
+						localErr = io.EOF
+						conn.Close()
+						return
+					case frameError:
+						state.to(stateClosed)
+						localErr = parseError(payload)
+						return
 					}
 				}
 			}()
 
-			// Read from the buffer and write to remote
-			timer := time.NewTicker(3 * time.Second)
-			for !close {
+			// Read from the buffer and write to remote, woken only when there
+			// is something to do and by the alarms for pings and delayed
+			// acknowledgements
+			var ackOffset int64 = -1
+			var bufErr error
+			var pinger, acker alarm
+			defer pinger.stop()
+			defer acker.stop()
+			if hb.interval > 0 {
+				pinger.set(hb.interval)
+			}
+			wake.notify() // send anything held back while reconnecting
+			for !closed() && !(state.ending() && buf.Len() == 0) {
+				var ackDue bool
 				select {
-				case <-timer.C:
-				case <-C:
-				}
-				if buf.Len() == 0 { // simulate activity, empty traffic
-					_, writeErr := dstConn.Write([]byte{})
-					if writeErr != nil {
-						close = true
+				case <-wake:
+				case <-pinger.C:
+					if payload, ok := hb.due(); ok && writeFrame(dstConn, framePing, payload) != nil {
+						atomic.StoreInt32(&dropped, 1)
 					}
+					pinger.set(hb.interval)
+				case <-acker.C:
+					ackDue = true
+					acker.stop()
 				}
-				for buf.Len() >= 2 {
-					bufMutex.Lock()
-					b := buf.Bytes()
-					sz := (int(b[0]) << 8) + int(b[1])
-					tosend := b[2 : 2+sz]
+				for !closed() {
+					tosend, end, err := buf.Peek(maxFrameData)
+					if err != nil {
+						// The stream is lost, end the session rather than send a gap
+						bufErr = fmt.Errorf("Buffer failed to maintain state: %s", err)
+						writeError(dstConn, failBuffer, err.Error())
+						atomic.StoreInt32(&dropped, 1)
+						break
+					}
+					if len(tosend) == 0 {
+						break
+					}
 					if *verbose {
-						fmt.Printf("toDST %q  off: %d buf: %d\n", tosend, bufOffset, buf.Len())
+						log.Printf("toDST %q  buf: %d", tosend, buf.Len())
 					}
-					wn, writeErr := dstConn.Write(tosend)
-					if writeErr != nil {
-						close = true
+					if writeErr := writeFrame(dstConn, frameData, tosend); writeErr != nil {
+						atomic.StoreInt32(&dropped, 1)
 					} else {
-						buf.Next(wn + 2)
-						bufOffset += int64(wn)
+						buf.Sent(end)
+					}
+				}
+				if off := atomic.LoadInt64(&hdr.Offset); off != ackOffset && !closed() {
+					// Confirm what has been received so the remote can let it go,
+					// once enough has built up or it has waited long enough for more
+					if ackDue || off-ackOffset >= ackEvery {
+						if writeAck(dstConn, off) != nil {
+							atomic.StoreInt32(&dropped, 1)
+						}
+						ackOffset = off
+						acker.stop()
+					} else if acker.C == nil {
+						acker.set(ackDelay)
 					}
-					bufMutex.Unlock()
+				}
+			}
+			if !closed() && state.ending() {
+				// Everything has been acknowledged, EOF the session
+				if *verbose {
+					log.Println("sending EOF signal")
+				}
+				if writeFrame(dstConn, frameClose, []byte{closeEOF}) == nil {
+					state.to(stateClosed)
 				}
 			}
 			dstConn.Close()
-			timer.Stop()
+			reading.Wait()
+			state.to(stateDetached)
+			if bufErr != nil {
+				return bufErr
+			}
 			return localErr
 		}()
 		if err != nil && *verbose {
 			log.Println("error in session", err)
 		}
 	}
+	if hdr.Kind == hdrNew {
+		// The session never got going, let the client know why
+		if err == nil {
+			err = errors.New("Session not established")
+		}
+		req.failed(conn, err)
+		return err
+	}
+	return nil
+}
+
+// Tries at opening a new session before the client is told it failed
+const newAttempts = 3
+
+// How long to wait for the server to answer a header before dropping the
+// transport.  A new session waits on the server opening the destination, so
+// is given long enough to hear back a timeout from it.
+func handshakeWait(kind uint16) time.Duration {
+	if kind == hdrNew {
+		return maxOpenTime + 5*time.Second
+	}
+	return 3 * time.Second
 }
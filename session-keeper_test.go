@@ -0,0 +1,566 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"flag"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	mrand "math/rand"
+
+	"github.com/google/uuid"
+)
+
+func TestMain(m *testing.M) {
+	flag.Parse()
+	if !testing.Verbose() {
+		log.SetOutput(io.Discard)
+	}
+	// Reconnect quickly, the tests cut transports far more often than a firewall
+	*retryDelay = 10 * time.Millisecond
+	*retryMax = 50 * time.Millisecond
+	os.Exit(m.Run())
+}
+
+// What the fake server does to a resume or close at one of its steps
+type fault int
+
+const (
+	faultNone  fault = iota
+	faultDrop        // drop the transport
+	faultStale       // turn it away as older than the latest resume
+	faultStall       // hold the transport and never answer
+)
+
+// Steps of a resume or close a fault may be put in
+const (
+	stepHello = iota // the header has been read
+	stepProof        // the proof has been accepted and the secret rotated
+)
+
+// A fake session-server, speaking enough of the protocol to hold sessions
+// which echo back everything sent on them
+type fakeServer struct {
+	addr string
+
+	mutex    sync.Mutex
+	fault    func(kind uint16, step int) fault
+	conns    []net.Conn
+	sessions map[uuid.UUID]*fakeSession
+}
+
+type fakeSession struct {
+	secret, prevSecret []byte
+	epoch              uint64   // latest resume let through
+	epochs             []uint64 // every epoch asked for, in the order they came
+	got                []byte   // everything received, which is all echoed back
+	conn               net.Conn // transport attached
+	closed             bool
+}
+
+// Run a fake server for the length of the test and point the keeper at it
+func startFakeServer(t *testing.T) *fakeServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeServer{addr: l.Addr().String(), sessions: make(map[uuid.UUID]*fakeSession)}
+	t.Cleanup(func() {
+		l.Close()
+		s.cut()
+	})
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			s.mutex.Lock()
+			s.conns = append(s.conns, conn)
+			s.mutex.Unlock()
+			go s.serve(conn)
+		}
+	}()
+	if targets, err = parseTargets(s.addr); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// Drop every transport at once, multiplexed ones included
+func (s *fakeServer) cut() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, c := range s.conns {
+		c.Close()
+	}
+	s.conns = nil
+}
+
+func (s *fakeServer) setFault(fn func(kind uint16, step int) fault) {
+	s.mutex.Lock()
+	s.fault = fn
+	s.mutex.Unlock()
+}
+
+// Put in the fault for the step if there is one, true when the transport is
+// then done with
+func (s *fakeServer) inject(conn net.Conn, hello ConnHeader, step int) bool {
+	s.mutex.Lock()
+	fn := s.fault
+	s.mutex.Unlock()
+	if fn == nil {
+		return false
+	}
+	switch fn(hello.Kind, step) {
+	case faultDrop:
+	case faultStale:
+		refuse(conn, hello, failStale, "stale resume")
+	case faultStall:
+		io.Copy(io.Discard, conn)
+	default:
+		return false
+	}
+	return true
+}
+
+func (s *fakeServer) serve(conn net.Conn) {
+	defer conn.Close()
+	hello, opts, err := readHeader(conn)
+	if err != nil {
+		return
+	}
+	switch hello.Kind {
+	case hdrMux:
+		if writeHeader(conn, replyHeader(hello, hdrEstablished, 0), nil) != nil {
+			return
+		}
+		m := newMux(conn, false, newHeartbeat(0, 0))
+		defer m.Close()
+		for {
+			stream, err := m.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(stream)
+		}
+	case hdrNew:
+		secret := newSecret()
+		sess := &fakeSession{secret: secret, conn: conn}
+		s.mutex.Lock()
+		s.sessions[hello.UUID] = sess
+		s.mutex.Unlock()
+		if writeHeader(conn, replyHeader(hello, hdrEstablished, 0),
+			map[byte][]byte{optSecret: secret, optServer: []byte("fake")}) != nil {
+			return
+		}
+		s.carry(conn, sess)
+	case hdrResume, hdrClose:
+		s.resume(conn, hello, parseEpoch(opts))
+	}
+}
+
+// Authenticate a resume or close the way the real server does, fencing off
+// epochs no later than the last let through
+func (s *fakeServer) resume(conn net.Conn, hello ConnHeader, epoch uint64) {
+	s.mutex.Lock()
+	sess := s.sessions[hello.UUID]
+	if sess == nil || sess.closed {
+		s.mutex.Unlock()
+		refuse(conn, hello, failUnknown, "unknown session")
+		return
+	}
+	sess.epochs = append(sess.epochs, epoch)
+	stale := epoch <= sess.epoch
+	serverOffset := int64(len(sess.got))
+	s.mutex.Unlock()
+	if s.inject(conn, hello, stepHello) {
+		return
+	} else if stale {
+		refuse(conn, hello, failStale, "stale resume")
+		return
+	}
+
+	nonce := newSecret()
+	if writeHeader(conn, replyHeader(hello, hdrChallenge, serverOffset),
+		map[byte][]byte{optNonce: nonce}) != nil {
+		return
+	}
+	proofHdr, opts, err := readHeader(conn)
+	if err != nil || proofHdr.Kind != hdrProof {
+		return
+	}
+	s.mutex.Lock()
+	code := uint16(0)
+	switch proof := opts[optProof]; {
+	case epoch <= sess.epoch:
+		code = failStale
+	case hmac.Equal(proof, resumeProof(sess.secret, nonce, hello.UUID, hello.Offset, serverOffset)):
+		sess.prevSecret, sess.secret = sess.secret, rotateSecret(sess.secret, nonce)
+	case hmac.Equal(proof, resumeProof(sess.prevSecret, nonce, hello.UUID, hello.Offset, serverOffset)):
+		sess.secret = rotateSecret(sess.prevSecret, nonce)
+	default:
+		code = failAuth
+	}
+	if code == 0 {
+		sess.epoch = epoch
+	}
+	s.mutex.Unlock()
+	if code != 0 {
+		refuse(conn, hello, code, "resume refused")
+		return
+	} else if s.inject(conn, hello, stepProof) {
+		return
+	}
+
+	s.mutex.Lock()
+	if sess.conn != nil {
+		sess.conn.Close()
+	}
+	if hello.Kind == hdrClose {
+		sess.closed, sess.conn = true, nil
+		s.mutex.Unlock()
+		writeHeader(conn, replyHeader(hello, hdrClosed, 0), nil)
+		return
+	}
+	if hello.Offset > int64(len(sess.got)) || sess.closed {
+		s.mutex.Unlock()
+		refuse(conn, hello, failBuffer, "offset past the end")
+		return
+	}
+	sess.conn = conn
+	offset := int64(len(sess.got))
+	resend := append([]byte(nil), sess.got[hello.Offset:]...)
+	s.mutex.Unlock()
+
+	if writeHeader(conn, replyHeader(hello, hdrEstablished, offset), nil) != nil {
+		return
+	}
+	for len(resend) > 0 {
+		n := len(resend)
+		if n > maxFrameData {
+			n = maxFrameData
+		}
+		if writeFrame(conn, frameData, resend[:n]) != nil {
+			return
+		}
+		resend = resend[n:]
+	}
+	s.carry(conn, sess)
+}
+
+// Echo back the data sent on the transport while it is the one attached
+func (s *fakeServer) carry(conn net.Conn, sess *fakeSession) {
+	r := bufio.NewReader(conn)
+	for {
+		typ, payload, err := readFrame(r)
+		if err != nil {
+			return
+		}
+		switch typ {
+		case frameData:
+			s.mutex.Lock()
+			if sess.conn != conn {
+				s.mutex.Unlock()
+				return
+			}
+			sess.got = append(sess.got, payload...)
+			off := int64(len(sess.got))
+			s.mutex.Unlock()
+			if writeFrame(conn, frameData, payload) != nil || writeAck(conn, off) != nil {
+				return
+			}
+		case framePing:
+			writeFrame(conn, framePong, payload)
+		case frameClose:
+			s.mutex.Lock()
+			sess.closed = true
+			s.mutex.Unlock()
+			return
+		}
+	}
+}
+
+// The local client of a session carried by keepSession
+type testClient struct {
+	conn net.Conn
+	done chan error // what keepSession returned
+
+	mutex sync.Mutex
+	sent  []byte
+	got   []byte
+}
+
+// Hand a new client connection to keepSession, reading back what it is sent
+// unless told not to
+func startClient(read bool) *testClient {
+	c := &testClient{done: make(chan error, 1)}
+	var keeperEnd net.Conn
+	c.conn, keeperEnd = net.Pipe()
+	go func() {
+		c.done <- keepSession(keeperEnd, &proxyRequest{proto: proxyRaw, hostport: "echo:7"})
+	}()
+	if read {
+		go func() {
+			buf := make([]byte, 4096)
+			for {
+				n, err := c.conn.Read(buf)
+				c.mutex.Lock()
+				c.got = append(c.got, buf[:n]...)
+				c.mutex.Unlock()
+				if err != nil {
+					return
+				}
+			}
+		}()
+	}
+	return c
+}
+
+func (c *testClient) send(n int) error {
+	p := make([]byte, n)
+	rand.Read(p)
+	c.mutex.Lock()
+	c.sent = append(c.sent, p...)
+	c.mutex.Unlock()
+	_, err := c.conn.Write(p)
+	return err
+}
+
+// Wait for everything sent to come back, and check it came back intact
+func (c *testClient) verify(t *testing.T) {
+	t.Helper()
+	for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		c.mutex.Lock()
+		got, sent := len(c.got), len(c.sent)
+		c.mutex.Unlock()
+		if got >= sent {
+			break
+		}
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if !bytes.Equal(c.got, c.sent) {
+		t.Fatalf("echoed %d bytes back for %d sent, or not the same bytes", len(c.got), len(c.sent))
+	}
+}
+
+// Wait for keepSession to return
+func (c *testClient) wait(t *testing.T, within time.Duration) error {
+	t.Helper()
+	select {
+	case err := <-c.done:
+		return err
+	case <-time.After(within):
+		t.Fatal("keepSession still running after", within)
+		return nil
+	}
+}
+
+// The one session opened on the server
+func (s *fakeServer) only(t *testing.T) (uuid.UUID, *fakeSession) {
+	t.Helper()
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if len(s.sessions) != 1 {
+		t.Fatalf("%d sessions opened, want 1", len(s.sessions))
+	}
+	for id, sess := range s.sessions {
+		return id, sess
+	}
+	return uuid.UUID{}, nil
+}
+
+// Wait a while for the session to be closed on the server, which may lag
+// behind keepSession returning
+func (s *fakeServer) closed(sess *fakeSession) bool {
+	for deadline := time.Now().Add(2 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		s.mutex.Lock()
+		closed := sess.closed
+		s.mutex.Unlock()
+		if closed || time.Now().After(deadline) {
+			return closed
+		}
+	}
+}
+
+// Check every resume and close of the session asked for a later epoch than
+// the one before
+func checkEpochs(t *testing.T, s *fakeServer, sess *fakeSession) {
+	t.Helper()
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for i := 1; i < len(sess.epochs); i++ {
+		if sess.epochs[i] <= sess.epochs[i-1] {
+			t.Fatalf("epoch %d asked for after %d", sess.epochs[i], sess.epochs[i-1])
+		}
+	}
+}
+
+// Keep cutting every transport at random until stopped
+func cutAtRandom(s *fakeServer) (stop func()) {
+	done := make(chan struct{})
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		for {
+			select {
+			case <-done:
+				return
+			case <-time.After(time.Duration(mrand.Intn(20000)) * time.Microsecond):
+				s.cut()
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-finished
+	}
+}
+
+// Data sent while transports are cut again and again, and resumes are
+// dropped part way through, arrives once and in order, and the session is
+// closed cleanly once the client goes
+func TestKeeperResumeAfterCut(t *testing.T) {
+	for _, mux := range []bool{false, true} {
+		name := "transport"
+		if mux {
+			name = "mux"
+		}
+		t.Run(name, func(t *testing.T) {
+			*useMux = mux
+			defer func() { *useMux = false }()
+			s := startFakeServer(t)
+			c := startClient(true)
+			c.send(100)
+			c.verify(t)
+
+			s.setFault(func(kind uint16, step int) fault {
+				if mrand.Intn(4) == 0 {
+					return faultDrop
+				}
+				return faultNone
+			})
+			stop := cutAtRandom(s)
+			for i := 0; i < 100; i++ {
+				c.send(1 + mrand.Intn(3*maxFrameData))
+				time.Sleep(time.Duration(mrand.Intn(1000)) * time.Microsecond)
+			}
+			stop()
+			s.setFault(nil)
+			c.verify(t)
+
+			c.conn.Close()
+			if err := c.wait(t, 10*time.Second); err != nil {
+				t.Fatal(err)
+			}
+			_, sess := s.only(t)
+			if !s.closed(sess) {
+				t.Fatal("session left open on the server after the client went")
+			}
+			checkEpochs(t, s, sess)
+		})
+	}
+}
+
+// A resume turned away as stale is tried again with a later epoch, and the
+// session carries on
+func TestKeeperStaleResume(t *testing.T) {
+	s := startFakeServer(t)
+	c := startClient(true)
+	defer c.conn.Close()
+	c.send(100)
+	c.verify(t)
+
+	var resumes int32
+	s.setFault(func(kind uint16, step int) fault {
+		if kind == hdrResume && step == stepHello && atomic.AddInt32(&resumes, 1) <= 2 {
+			return faultStale
+		}
+		return faultNone
+	})
+	s.cut()
+	c.send(100)
+	c.verify(t)
+
+	_, sess := s.only(t)
+	checkEpochs(t, s, sess)
+	s.mutex.Lock()
+	asked := len(sess.epochs)
+	s.mutex.Unlock()
+	if asked < 3 {
+		t.Fatalf("%d resumes asked for, want the 2 stale ones and a later one", asked)
+	}
+}
+
+// A client going away while transports, resumes and closes are dropped has
+// keepSession return, and the session closed on the server unless the close
+// itself was lost
+func TestKeeperCloseWhileCut(t *testing.T) {
+	for i := 0; i < 10; i++ {
+		s := startFakeServer(t)
+		c := startClient(i%2 == 0)
+		c.send(1000)
+		if i%2 == 0 {
+			c.verify(t)
+		}
+
+		var closesLost int32
+		s.setFault(func(kind uint16, step int) fault {
+			if mrand.Intn(3) != 0 {
+				return faultNone
+			}
+			if kind == hdrClose {
+				atomic.AddInt32(&closesLost, 1)
+			}
+			return faultDrop
+		})
+		stop := cutAtRandom(s)
+		c.send(1 + mrand.Intn(3*maxFrameData))
+		c.conn.Close()
+		c.wait(t, 10*time.Second)
+		stop()
+
+		_, sess := s.only(t)
+		checkEpochs(t, s, sess)
+		if atomic.LoadInt32(&closesLost) == 0 && !s.closed(sess) {
+			t.Fatalf("round %d: session left open on the server after the client went", i)
+		}
+	}
+}
+
+// A server which takes the close and never answers does not hold up the end
+// of the session for longer than the close wait
+func TestKeeperCloseStalled(t *testing.T) {
+	s := startFakeServer(t)
+	s.setFault(func(kind uint16, step int) fault {
+		if kind == hdrClose {
+			return faultStall
+		}
+		return faultNone
+	})
+	// The echo comes back to a client which has gone, so the session ends
+	// with a close on a new transport
+	c := startClient(false)
+	c.send(100)
+	c.conn.Close()
+	start := time.Now()
+	c.wait(t, handshakeWait(hdrClose)+5*time.Second)
+
+	_, sess := s.only(t)
+	s.mutex.Lock()
+	asked := len(sess.epochs)
+	s.mutex.Unlock()
+	if asked == 0 {
+		t.Fatalf("no close sent, keepSession returned after %s", time.Since(start))
+	}
+}
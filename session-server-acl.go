@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+var (
+	ruleFile      = flag.String("rules", "", "File of destination rules, one per line as with -rule, checked after those given with -rule")
+	defaultAction = flag.String("default", "allow", "Action for destinations no rule matches (allow or deny)")
+	ruleList      listFlag
+
+	acl        []*aclRule
+	aclDefault bool
+)
+
+// How long to wait on resolving a destination name
+
+// An aclRule allows or denies destinations by name or address, and port.  The
+// first rule matching a destination decides.
+type aclRule struct {
+	text  string
+	allow bool
+	host  string           // glob on the requested name, empty for a network
+	ipnet *net.IPNet       // network the resolved address is in
+	ports map[int]struct{} // nil for any port
+}
+
+// Parse a rule given as "allow|deny host|cidr [ports]", where the host is a
+// glob such as *.example.com and the ports are as with -allowed
+func parseRule(text string) (*aclRule, error) {
+	fields := strings.Fields(text)
+	if len(fields) < 2 || len(fields) > 3 {
+		return nil, errors.New("expected allow|deny host|cidr [ports]: " + text)
+	}
+	r := &aclRule{text: strings.Join(fields, " ")}
+	switch fields[0] {
+	case "allow":
+		r.allow = true
+	case "deny":
+	default:
+		return nil, errors.New("unknown action " + fields[0])
+	}
+	if _, ipnet, err := net.ParseCIDR(fields[1]); err == nil {
+		r.ipnet = ipnet
+	} else if ip := net.ParseIP(fields[1]); ip != nil {
+		bits := 128
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, bits = ip4, 32
+		}
+		r.ipnet = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+	} else if _, err := path.Match(fields[1], ""); err != nil {
+		return nil, errors.New("bad host pattern " + fields[1])
+	} else {
+		r.host = strings.ToLower(fields[1])
+	}
+	if len(fields) == 3 && fields[2] != "*" {
+		r.ports = hypenRange(fields[2])
+	}
+	return r, nil
+}
+
+// Load the rules given with -rule and -rules, exiting when one is unusable
+func loadRules() {
+	switch *defaultAction {
+	case "allow":
+		aclDefault = true
+	case "deny":
+	default:
+		fmt.Println("Error: -default must be allow or deny")
+		os.Exit(1)
+	}
+	lines := []string(ruleList)
+	if *ruleFile != "" {
+		f, err := os.Open(*ruleFile)
+		if err != nil {
+			fmt.Println("Error opening rules:", err)
+			os.Exit(1)
+		}
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			if line := strings.TrimSpace(scanner.Text()); line != "" && !strings.HasPrefix(line, "#") {
+				lines = append(lines, line)
+			}
+		}
+		f.Close()
+	}
+	for _, line := range lines {
+		r, err := parseRule(line)
+		if err != nil {
+			fmt.Println("Error parsing rule:", err)
+			os.Exit(1)
+		}
+		acl = append(acl, r)
+	}
+}
+
+func (r *aclRule) matches(name string, ip net.IP, port int) bool {
+	if r.ports != nil {
+		if _, ok := r.ports[port]; !ok {
+			return false
+		}
+	}
+	if r.ipnet != nil {
+		return r.ipnet.Contains(ip)
+	}
+	ok, _ := path.Match(r.host, name)
+	return ok
+}
+
+// Decide whether a resolved address of the requested name may be reached,
+// giving the rule which decided.  The rules of the identity come first.
+func checkRules(name string, ip net.IP, port int, id *identity) (bool, string) {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	rules := acl
+	if id != nil {
+		rules = append(id.rules[:len(id.rules):len(id.rules)], acl...)
+	}
+	for _, r := range rules {
+		if r.matches(name, ip, port) {
+			return r.allow, "rule \"" + r.text + "\""
+		}
+	}
+	return aclDefault, "the default action"
+}
+
+// Resolve the requested name and keep the addresses the rules allow, so the
+// name cannot stand in for an address which is denied
+func allowedAddrs(ctx context.Context, host string, port int, id *identity) ([]net.IP, error) {
+	var ips []net.IP
+	if ip := net.ParseIP(host); ip != nil {
+		ips = []net.IP{ip}
+	} else {
+		addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		for _, a := range addrs {
+			ips = append(ips, a.IP)
+		}
+	}
+	var allowed []net.IP
+	for _, ip := range ips {
+		ok, by := checkRules(host, ip, port, id)
+		if ok {
+			log.Println("Allowed", net.JoinHostPort(host, strconv.Itoa(port)), "at", ip, "for", id, "by", by)
+			allowed = append(allowed, ip)
+		} else {
+			log.Println("Denied", net.JoinHostPort(host, strconv.Itoa(port)), "at", ip, "for", id, "by", by)
+		}
+	}
+	return allowed, nil
+}
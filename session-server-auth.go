@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var identityFile = flag.String("identities", "", "File of keeper identities and the policy for each, when given every new session must present one")
+
+// An identity is a keeper, or group of keepers, known by a pre-shared token
+// or by the common name of its client certificate
+type identity struct {
+	name     string
+	token    []byte
+	cert     string
+	rules    []*aclRule    // checked before the server wide rules
+	sessions int           // most sessions held at once, 0 for no limit
+	quota    *memoryBudget // bytes buffered across its sessions, nil for no limit
+	held     int           // sessions held now
+}
+
+var (
+	identities    []*identity
+	identityMutex sync.Mutex
+)
+
+// Load the identities file, exiting when it is unusable.  Each identity
+// starts with an "identity name" line, followed by lines setting it up:
+//
+//	token <pre-shared token>
+//	cert <client certificate common name>
+//	sessions <most held at once>
+//	quota <most bytes buffered across its sessions, K, M or G suffix>
+//	allow|deny <host|cidr> [ports]
+func loadIdentities(path string) {
+	f, err := os.Open(path)
+	if err != nil {
+		fmt.Println("Error opening identities:", err)
+		os.Exit(1)
+	}
+	defer f.Close()
+	fail := func(line int, err error) {
+		fmt.Printf("Error in identities line %d: %s\n", line, err)
+		os.Exit(1)
+	}
+	var id *identity
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, value := line, ""
+		if i := strings.IndexAny(line, " \t"); i > 0 {
+			key, value = line[:i], strings.TrimSpace(line[i:])
+		}
+		if key == "identity" {
+			id = &identity{name: value}
+			identities = append(identities, id)
+			continue
+		} else if id == nil {
+			fail(n, errors.New("expected an identity line first"))
+		}
+		switch key {
+		case "token":
+			id.token = []byte(value)
+		case "cert":
+			id.cert = value
+		case "sessions":
+			if id.sessions, err = strconv.Atoi(value); err != nil {
+				fail(n, err)
+			}
+		case "quota":
+			var size sizeFlag
+			if err = size.Set(value); err != nil {
+				fail(n, err)
+			}
+			id.quota = newMemoryBudget(int(size), budget)
+		case "allow", "deny":
+			r, err := parseRule(line)
+			if err != nil {
+				fail(n, err)
+			}
+			id.rules = append(id.rules, r)
+		default:
+			fail(n, errors.New("unknown setting "+key))
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		fail(0, err)
+	}
+}
+
+// Find the identity a new session comes from by the token it gave, or else
+// by its client certificate
+func identify(conn net.Conn, token []byte) (*identity, error) {
+	if len(token) > 0 {
+		for _, id := range identities {
+			if len(id.token) > 0 && hmac.Equal(id.token, token) {
+				return id, nil
+			}
+		}
+		return nil, errors.New("unknown token")
+	}
+	if cn := peerName(conn); cn != "" {
+		for _, id := range identities {
+			if id.cert == cn {
+				return id, nil
+			}
+		}
+		return nil, errors.New("unknown certificate " + cn)
+	}
+	return nil, errors.New("identity required")
+}
+
+// The common name of the client certificate the keeper presented, if any
+func peerName(conn net.Conn) string {
+	if s, ok := conn.(*muxStream); ok {
+		conn = s.m.conn
+	}
+	if tc, ok := conn.(*tls.Conn); ok {
+		if certs := tc.ConnectionState().PeerCertificates; len(certs) > 0 {
+			return certs[0].Subject.CommonName
+		}
+	}
+	return ""
+}
+
+func lookupIdentity(name string) *identity {
+	for _, id := range identities {
+		if id.name == name {
+			return id
+		}
+	}
+	return nil
+}
+
+// Count a new session against the identity, false when it holds as many as
+// it may
+func (id *identity) acquire() bool {
+	if id == nil {
+		return true
+	}
+	identityMutex.Lock()
+	defer identityMutex.Unlock()
+	if id.sessions > 0 && id.held >= id.sessions {
+		return false
+	}
+	id.held++
+	return true
+}
+
+func (id *identity) release() {
+	if id == nil {
+		return
+	}
+	identityMutex.Lock()
+	id.held--
+	identityMutex.Unlock()
+}
+
+func (id *identity) String() string {
+	if id == nil {
+		return "anonymous"
+	}
+	return id.name
+}
+
+// Let buffers go past every memory limit while sessions are handed off, or
+// hold them to the limits again
+func setBudgetsUnlimited(on bool) {
+	budget.setUnlimited(on)
+	for _, id := range identities {
+		id.quota.setUnlimited(on)
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+var (
+	peerList    = flag.String("peers", "", "Comma separated addresses of every session-server in the cluster, this one included, so a resume landing on any of them reaches the one holding the session")
+	peerKeyFile = flag.String("peerkey", "", "File holding a secret shared by every session-server in the cluster, which peers prove knowledge of before asking after a session")
+)
+
+var (
+	peers   []string
+	peerTLS *tls.Config
+	peerKey []byte
+)
+
+// How long a peer has to answer whether it holds a session
+const peerTimeout = 2 * time.Second
+
+// Join the cluster given with -peers.  Every node given the same list takes
+// the same identity, so keepers treat the whole pool as one server.
+func setupCluster(cfg *tls.Config) {
+	if cfg != nil && cfg.ClientCAs == nil {
+		fmt.Println("Error: -peers with -tls needs -ca to verify the certificates of the other nodes")
+		os.Exit(1)
+	}
+	b, err := os.ReadFile(*peerKeyFile)
+	if *peerKeyFile == "" {
+		err = fmt.Errorf("-peers needs -peerkey")
+	}
+	if peerKey = bytes.TrimSpace(b); err == nil && len(peerKey) == 0 {
+		err = fmt.Errorf("%s is empty", *peerKeyFile)
+	}
+	if err != nil {
+		fmt.Println("Error reading cluster key:", err)
+		os.Exit(1)
+	}
+	for _, addr := range strings.Split(*peerList, ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			peers = append(peers, addr)
+		}
+	}
+	sort.Strings(peers)
+	sum := sha256.Sum256([]byte(strings.Join(peers, ",")))
+	copy(serverID[:], sum[:])
+	if cfg != nil {
+		// Peers present this server's certificate and expect one from the CA
+		peerTLS = &tls.Config{Certificates: cfg.Certificates, RootCAs: cfg.ClientCAs, MinVersion: tls.VersionTLS12}
+	}
+}
+
+func dialPeer(addr string) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: peerTimeout}
+	if peerTLS != nil {
+		cfg := peerTLS.Clone()
+		cfg.ServerName, _, _ = net.SplitHostPort(addr)
+		return tls.DialWithDialer(dialer, "tcp", addr, cfg)
+	}
+	return dialer.Dial("tcp", addr)
+}
+
+// Answer a peer asking whether this server holds a session, once it has
+// proven it holds the cluster key
+func serveLookup(conn net.Conn, hello ConnHeader) {
+	if len(peers) == 0 {
+		refuse(conn, hello, failProtocol, "not part of a cluster")
+		return
+	}
+	nonce := newSecret()
+	conn.SetDeadline(time.Now().Add(peerTimeout))
+	if writeHeader(conn, replyHeader(hello, hdrChallenge, 0), map[byte][]byte{optNonce: nonce}) != nil {
+		return
+	}
+	proofHdr, opts, err := readHeader(conn)
+	if err != nil || proofHdr.Kind != hdrProof || proofHdr.UUID != hello.UUID {
+		refuse(conn, hello, failProtocol, "expected a proof header")
+		return
+	}
+	if !hmac.Equal(opts[optProof], resumeProof(peerKey, nonce, hello.UUID, 0, 0)) {
+		log.Println("Failed peer authentication for lookup of", hello.UUID.String(), "from", conn.RemoteAddr())
+		refuse(conn, hello, failAuth, "peer authentication failed")
+		return
+	}
+	_, ok := lookupSession(hello.UUID)
+	switch {
+	case ok:
+		writeHeader(conn, replyHeader(hello, hdrEstablished, 0), nil)
+	case isExpired(hello.UUID):
+		refuse(conn, hello, failExpired, "session expired")
+	default:
+		refuse(conn, hello, failUnknown, "unknown session")
+	}
+}
+
+// Ask every peer at once whether it holds the session, giving the address
+// of the one which does, or the failure code to report when none does
+func lookupPeer(id uuid.UUID) (string, uint16) {
+	type answer struct {
+		addr string
+		code uint16
+	}
+	answers := make(chan answer, len(peers))
+	for _, addr := range peers {
+		go func(addr string) {
+			code := uint16(failUnknown)
+			defer func() { answers <- answer{addr, code} }()
+			conn, err := dialPeer(addr)
+			if err != nil {
+				log.Println("Could not reach peer", addr, err)
+				return
+			}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(peerTimeout))
+			key := peerKey // the handshake replaces, never changes, the key given
+			rcvHdr, _, err := handshake(conn, newHeader(hdrLookup, id, 0), nil, &key)
+			if err != nil {
+				log.Println("Could not ask peer", addr, "about", id.String(), err)
+				return
+			}
+			if rcvHdr.Kind == hdrEstablished {
+				code = 0
+			} else if rcvHdr.Kind == hdrError {
+				err = readError(conn)
+				if re, ok := err.(*remoteError); ok && re.Code == failExpired {
+					code = failExpired
+				} else if !ok || re.Code != failUnknown {
+					log.Println("Peer", addr, "refused the lookup of", id.String(), err)
+				}
+			}
+		}(addr)
+	}
+	code := uint16(failUnknown)
+	for range peers {
+		a := <-answers
+		if a.code == 0 {
+			return a.addr, 0
+		} else if a.code == failExpired {
+			code = failExpired
+		}
+	}
+	return "", code
+}
+
+// Hand a resume for a session this server does not hold on to the peer
+// which does, then carry the transport through untouched.  The failure code
+// is given when no peer holds it.
+func forwardToPeer(conn net.Conn, hello ConnHeader, opts map[byte][]byte) uint16 {
+	addr, code := lookupPeer(hello.UUID)
+	if addr == "" {
+		return code
+	}
+	peerConn, err := dialPeer(addr)
+	if err != nil {
+		log.Println("Could not reach peer", addr, err)
+		return failUnknown
+	}
+	defer peerConn.Close()
+	if *verbose {
+		log.Println("Forwarding", hello.UUID.String(), "to peer", addr)
+	}
+	opts[optForwarded] = nil
+	if writeHeader(peerConn, hello, opts) != nil {
+		return failUnknown
+	}
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(peerConn, conn)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(conn, peerConn)
+		done <- struct{}{}
+	}()
+	<-done
+	return 0
+}
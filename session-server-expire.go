@@ -0,0 +1,131 @@
+package main
+
+import (
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// How long to remember expired sessions, so a late resume is told why
+const expiredMemory = 24 * time.Hour
+
+// How long a new session is kept detached when the keeper never showed it got
+// the reply, it cannot resume without the secret that reply carried
+const pendingGrace = time.Minute
+
+var (
+	expired      = make(map[uuid.UUID]time.Time)
+	expiredMutex sync.Mutex
+)
+
+// Note data moving on the session
+func (s *session) touch() {
+	s.stateMutex.Lock()
+	s.seen = time.Now()
+	s.stateMutex.Unlock()
+}
+
+// Note the keeper has the session secret, having used the session
+func (s *session) confirm() {
+	s.stateMutex.Lock()
+	s.pending = false
+	s.stateMutex.Unlock()
+}
+
+// Whether a request for a new session is its keeper asking again, having
+// never had the reply opening it, rather than someone else using the id
+func (s *session) retried(conn net.Conn, opts map[byte][]byte) bool {
+	s.stateMutex.Lock()
+	pending := s.pending
+	s.stateMutex.Unlock()
+	if !pending {
+		return false
+	} else if *identityFile == "" {
+		return true
+	}
+	id, err := identify(conn, opts[optToken])
+	return err == nil && id == s.identity
+}
+
+// Note a transport has been attached
+func (s *session) attach() {
+	s.stateMutex.Lock()
+	s.detached = time.Time{}
+	s.stateMutex.Unlock()
+	s.state.to(stateEstablished)
+}
+
+// Note the transport has gone away
+func (s *session) detach() {
+	s.stateMutex.Lock()
+	s.detached = time.Now()
+	s.stateMutex.Unlock()
+	s.state.to(stateDetached)
+}
+
+// Give the reason the session should expire, if it should
+func (s *session) expiry(now time.Time) string {
+	s.stateMutex.Lock()
+	defer s.stateMutex.Unlock()
+	if *idleTimeout > 0 && now.Sub(s.seen) > *idleTimeout {
+		return "idle since " + s.seen.Format(time.RFC3339)
+	}
+	if s.pending && !s.detached.IsZero() && now.Sub(s.detached) > pendingGrace {
+		return "never taken up, detached since " + s.detached.Format(time.RFC3339)
+	}
+	if *detachedTime > 0 && !s.detached.IsZero() && now.Sub(s.detached) > *detachedTime {
+		return "detached since " + s.detached.Format(time.RFC3339)
+	}
+	return ""
+}
+
+// Close down a session the keeper has abandoned, remembering it so a late
+// resume is refused as expired
+func (s *session) expire(reason string) {
+	log.Println("Expiring session", s.hdr.UUID.String(), "of", s.identity, reason)
+	s.remove()
+	expiredMutex.Lock()
+	expired[s.hdr.UUID] = time.Now()
+	expiredMutex.Unlock()
+	s.conn.Close()
+	s.closeTransport()
+}
+
+// Report whether a session was expired
+func isExpired(id uuid.UUID) bool {
+	expiredMutex.Lock()
+	defer expiredMutex.Unlock()
+	_, ok := expired[id]
+	return ok
+}
+
+// Periodically look over the sessions for any to expire
+func reapSessions() {
+	for now := range time.Tick(10 * time.Second) {
+		if isHandingOff() {
+			continue
+		}
+		var reap []*session
+		var reasons []string
+		for _, s := range allSessions() {
+			if reason := s.expiry(now); reason != "" {
+				reap = append(reap, s)
+				reasons = append(reasons, reason)
+			}
+		}
+		for i, s := range reap {
+			s.expire(reasons[i])
+		}
+
+		expiredMutex.Lock()
+		for id, t := range expired {
+			if now.Sub(t) > expiredMemory {
+				delete(expired, id)
+			}
+		}
+		expiredMutex.Unlock()
+	}
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+var handoffPath = flag.String("handoff", "", "Unix socket for upgrades: a server started with the same path takes over the listener and every session of the running one")
+
+// Largest packet sent over the handoff socket
+const handoffPacket = 1 << 16
+
+var (
+	handingOff int32                     // set while sessions are being moved out
+	relisten   = make(chan net.Listener) // the listener back when a handoff failed
+)
+
+// A message on the handoff socket, the descriptor it refers to comes along
+// with it
+type handoffMsg struct {
+	Kind    string // listener, session or done
+	Server  uuid.UUID
+	Session *handoffSession `json:",omitempty"`
+}
+
+// The state of a session being moved, followed by Held bytes of its buffer
+type handoffSession struct {
+	Header             ConnHeader
+	Secret, PrevSecret []byte
+	CloseLocal         bool
+	Seen, Detached     time.Time
+	Start, Held        int64
+	Identity           string
+	Epoch              uint64
+	Pending            bool
+}
+
+func isHandingOff() bool { return atomic.LoadInt32(&handingOff) != 0 }
+
+// Wait on the handoff socket for an upgraded server to take over
+func serveHandoff(path string, raw net.Listener, cfg *tls.Config) {
+	os.Remove(path)
+	hl, err := net.ListenUnix("unixpacket", &net.UnixAddr{Name: path, Net: "unixpacket"})
+	if err != nil {
+		fmt.Println("Error listening for handoff:", err)
+		os.Exit(1)
+	}
+	for {
+		uc, err := hl.AcceptUnix()
+		if err != nil {
+			continue
+		}
+		// The socket file now belongs to the upgraded server
+		hl.SetUnlinkOnClose(false)
+		if raw, err = handOff(uc, raw, cfg); err != nil {
+			log.Println("Handoff failed, carrying on:", err)
+			hl.SetUnlinkOnClose(true)
+		}
+		uc.Close()
+	}
+}
+
+// Move the listener and every session to the upgraded server at the other end
+// of uc, exiting once it has them.  On failure everything is started up again
+// here, giving back the listener now in use.
+func handOff(uc *net.UnixConn, raw net.Listener, cfg *tls.Config) (net.Listener, error) {
+	log.Println("Handing over to an upgraded server")
+	lf, err := raw.(*net.TCPListener).File()
+	if err != nil {
+		return raw, err
+	}
+	defer lf.Close()
+	atomic.StoreInt32(&handingOff, 1)
+	raw.Close()
+	setBudgetsUnlimited(true)
+
+	var moved []*session
+	err = func() error {
+		if err := sendHandoff(uc, handoffMsg{Kind: "listener", Server: serverID}, lf); err != nil {
+			return err
+		}
+		for _, s := range allSessions() {
+			if _, ok := s.conn.(*net.TCPConn); !ok {
+				// A reverse tunnel listening in this process, the keeper opens it again
+				continue
+			}
+			s.quiesce()
+			moved = append(moved, s)
+			if err := sendSession(uc, s); err != nil {
+				return err
+			}
+		}
+		if err := sendHandoff(uc, handoffMsg{Kind: "done"}, nil); err != nil {
+			return err
+		}
+		// Only go once the upgraded server has everything
+		uc.SetReadDeadline(time.Now().Add(time.Minute))
+		if ack, _, err := recvHandoff(uc); err != nil || string(ack) != "ok" {
+			return errors.New("upgraded server did not take over")
+		}
+		return nil
+	}()
+	if err == nil {
+		log.Println("Handed over", len(moved), "sessions, exiting")
+		os.Exit(0)
+	}
+
+	// Start everything back up
+	for _, s := range moved {
+		s.resume()
+	}
+	setBudgetsUnlimited(false)
+	l, lerr := net.FileListener(lf)
+	if lerr != nil {
+		fmt.Println("Error taking back the listener:", lerr)
+		os.Exit(1)
+	}
+	atomic.StoreInt32(&handingOff, 0)
+	if cfg != nil {
+		relisten <- tls.NewListener(l, cfg)
+	} else {
+		relisten <- l
+	}
+	return l, err
+}
+
+// Stop all activity on a session, leaving the destination open.  The session
+// mutex is kept until it is resumed or the process exits.
+func (s *session) quiesce() {
+	atomic.StoreInt32(&s.handoff, 1)
+	s.closeTransport()
+	s.mutex.Lock()
+	s.buf.SetUnlimited(true)
+	s.conn.SetReadDeadline(time.Unix(1, 0))
+	<-s.readDone
+}
+
+// Start a quiesced session up again
+func (s *session) resume() {
+	atomic.StoreInt32(&s.handoff, 0)
+	s.conn.SetReadDeadline(time.Time{})
+	s.buf.SetUnlimited(false)
+	s.readDone = make(chan struct{})
+	go readFromDST(s)
+	s.mutex.Unlock()
+}
+
+func sendSession(uc *net.UnixConn, s *session) error {
+	s.authMutex.Lock()
+	s.stateMutex.Lock()
+	state := &handoffSession{
+		Header:     *s.hdr,
+		Secret:     s.secret,
+		PrevSecret: s.prevSecret,
+		Epoch:      s.epoch,
+		CloseLocal: s.state.ending(),
+		Seen:       s.seen,
+		Detached:   s.detached,
+		Pending:    s.pending,
+		Start:      s.buf.Start(),
+		Held:       int64(s.buf.Len()),
+	}
+	if s.identity != nil {
+		state.Identity = s.identity.name
+	}
+	s.stateMutex.Unlock()
+	s.authMutex.Unlock()
+	state.Header.Offset = atomic.LoadInt64(&s.hdr.Offset)
+	var f *os.File
+	if !state.CloseLocal {
+		var err error
+		if f, err = s.conn.(*net.TCPConn).File(); err != nil {
+			return err
+		}
+		defer f.Close()
+	}
+	if err := sendHandoff(uc, handoffMsg{Kind: "session", Session: state}, f); err != nil {
+		return err
+	}
+	return s.buf.Export(func(p []byte) error {
+		for len(p) > 0 {
+			n := len(p)
+			if n > handoffPacket {
+				n = handoffPacket
+			}
+			if _, _, err := uc.WriteMsgUnix(p[:n], nil, nil); err != nil {
+				return err
+			}
+			p = p[n:]
+		}
+		return nil
+	})
+}
+
+// Take over the listener and sessions of a server already running with the
+// handoff socket, nil when there is none
+func takeOver(path string) net.Listener {
+	c, err := net.Dial("unixpacket", path)
+	if err != nil {
+		return nil
+	}
+	uc := c.(*net.UnixConn)
+	defer uc.Close()
+	fmt.Println("Taking over from the running server")
+	fail := func(err error) {
+		// The running server carries on when this one goes without answering
+		fmt.Println("Error taking over:", err)
+		os.Exit(1)
+	}
+
+	var l net.Listener
+	var restored []*session
+	for {
+		p, f, err := recvHandoff(uc)
+		if err != nil {
+			fail(err)
+		}
+		var msg handoffMsg
+		if err := json.Unmarshal(p, &msg); err != nil {
+			fail(err)
+		}
+		switch msg.Kind {
+		case "listener":
+			if f == nil {
+				fail(errors.New("no listener was handed over"))
+			}
+			if l, err = net.FileListener(f); err != nil {
+				fail(err)
+			}
+			f.Close()
+			serverID = msg.Server
+		case "session":
+			s, err := restoreSession(uc, msg.Session, f)
+			if err != nil {
+				fail(err)
+			}
+			restored = append(restored, s)
+		case "done":
+			if l == nil {
+				fail(errors.New("no listener was handed over"))
+			}
+			if _, _, err := uc.WriteMsgUnix([]byte("ok"), nil, nil); err != nil {
+				fail(err)
+			}
+			for _, s := range restored {
+				go readFromDST(s)
+				storeSession(s)
+			}
+			fmt.Println("Took over", len(restored), "sessions")
+			return l
+		}
+	}
+}
+
+// Build a session from its handed over state, reading in its buffer
+func restoreSession(uc *net.UnixConn, state *handoffSession, f *os.File) (*session, error) {
+	if state == nil {
+		return nil, errors.New("session state missing")
+	}
+	hdr := state.Header
+	s := &session{
+		wake:       newWakeup(),
+		hdr:        &hdr,
+		secret:     state.Secret,
+		prevSecret: state.PrevSecret,
+		epoch:      state.Epoch,
+		seen:       state.Seen,
+		detached:   state.Detached,
+		pending:    state.Pending,
+		readDone:   make(chan struct{}),
+		identity:   lookupIdentity(state.Identity),
+	}
+	s.state.to(stateDetached)
+	if state.CloseLocal {
+		s.state.to(stateClosing)
+	}
+	s.buf.limit, s.buf.budget = int(bufferSize), budget
+	if s.identity != nil {
+		// Counted against the identity whatever its limit is now
+		identityMutex.Lock()
+		s.identity.held++
+		identityMutex.Unlock()
+		if s.identity.quota != nil {
+			s.buf.budget = s.identity.quota
+		}
+	}
+	s.buf.spill = newSpill(*spillDir, int64(spillLimit))
+	s.buf.Restore(state.Start)
+	for held := int64(0); held < state.Held; {
+		p, _, err := recvHandoff(uc)
+		if err != nil {
+			return nil, err
+		}
+		if err = s.buf.Import(p); err != nil {
+			return nil, err
+		}
+		held += int64(len(p))
+	}
+	if f == nil {
+		// The destination had already closed, stand in a closed one
+		s.conn, _ = net.Pipe()
+		s.conn.Close()
+		return s, nil
+	}
+	defer f.Close()
+	var err error
+	s.conn, err = net.FileConn(f)
+	return s, err
+}
+
+// Send a message, with a descriptor when f is given
+func sendHandoff(uc *net.UnixConn, msg handoffMsg, f *os.File) error {
+	p, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	var oob []byte
+	if f != nil {
+		oob = syscall.UnixRights(int(f.Fd()))
+	}
+	_, _, err = uc.WriteMsgUnix(p, oob, nil)
+	return err
+}
+
+// Read a packet, along with the descriptor which came with it if any
+func recvHandoff(uc *net.UnixConn) ([]byte, *os.File, error) {
+	p := make([]byte, handoffPacket)
+	oob := make([]byte, syscall.CmsgSpace(4))
+	n, oobn, _, _, err := uc.ReadMsgUnix(p, oob)
+	if err != nil {
+		return nil, nil, err
+	} else if n == 0 {
+		return nil, nil, errors.New("handoff socket closed")
+	}
+	var f *os.File
+	if msgs, err := syscall.ParseSocketControlMessage(oob[:oobn]); err == nil && len(msgs) > 0 {
+		if fds, err := syscall.ParseUnixRights(&msgs[0]); err == nil && len(fds) > 0 {
+			f = os.NewFile(uintptr(fds[0]), "handoff")
+		}
+	}
+	return p[:n], f, nil
+}
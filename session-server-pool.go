@@ -0,0 +1,50 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"sync"
+	"syscall"
+)
+
+const readSize = 10000 // most read from a destination at once
+
+// Buffers are shared between sessions rather than each holding its own while
+// it waits, so an idle session costs little more than its goroutine, socket
+// and replay buffer
+var (
+	readBufs     = sync.Pool{New: func() interface{} { return new([readSize]byte) }}
+	frameReaders = sync.Pool{New: func() interface{} { return bufio.NewReader(nil) }}
+)
+
+// A reader of frames from a transport, given back with putFrameReader
+func getFrameReader(conn net.Conn) *bufio.Reader {
+	r := frameReaders.Get().(*bufio.Reader)
+	r.Reset(conn)
+	return r
+}
+
+func putFrameReader(r *bufio.Reader) {
+	r.Reset(nil)
+	frameReaders.Put(r)
+}
+
+// Wait until a connection has something to read, or has failed, without
+// holding a buffer while waiting.  A connection which cannot be waited on
+// this way returns straight away and the read does the waiting instead.
+func waitReadable(conn net.Conn) {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return
+	}
+	// Errors, a deadline passing included, are left for the read to report
+	rc.Read(func(fd uintptr) bool {
+		var peek [1]byte
+		_, _, err := syscall.Recvfrom(int(fd), peek[:], syscall.MSG_PEEK|syscall.MSG_DONTWAIT)
+		return err != syscall.EAGAIN
+	})
+}
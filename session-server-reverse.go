@@ -0,0 +1,67 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net"
+	"strconv"
+
+	"github.com/google/uuid"
+)
+
+// Listen on the remote side for a reverse tunnel.  Each connection accepted
+// becomes a new session, announced to the keeper with its id and secret over
+// the returned connection, which is carried by the control session.  The
+// keeper then attaches to the new session as if resuming it.  The new sessions
+// belong to the identity which opened the tunnel.
+func reverseListen(addr string, id *identity) (net.Conn, uint16, error) {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, failProtocol, errors.New("could not parse listen address " + addr)
+	}
+	if p, err := strconv.Atoi(port); err != nil {
+		return nil, failProtocol, errors.New("could not parse port " + addr)
+	} else if _, ok := reversePorts[p]; !ok {
+		log.Println("Not an allowed reverse port:", addr)
+		return nil, failDenied, errors.New("reverse port not allowed " + addr)
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Println("Could not listen for reverse tunnel:", addr)
+		return nil, failDial, err
+	}
+	log.Println("Listening for reverse tunnel on", addr)
+
+	local, control := net.Pipe()
+	go func() {
+		// Nothing is expected from the keeper, when the control session ends
+		// stop listening
+		io.Copy(io.Discard, control)
+		l.Close()
+	}()
+	go func() {
+		defer control.Close()
+		for {
+			inConn, err := l.Accept()
+			if err != nil {
+				log.Println("Closed reverse tunnel on", addr)
+				return
+			}
+			if *verbose {
+				log.Println("Incoming reverse connection", inConn.RemoteAddr(), "on", addr)
+			}
+			if !id.acquire() {
+				log.Println("Session limit reached for", id, "refusing reverse connection on", addr)
+				inConn.Close()
+				continue
+			}
+			s := newSession(&ConnHeader{UUID: uuid.New()}, inConn, id)
+			if _, err := control.Write(append(s.hdr.UUID[:], s.secret...)); err != nil {
+				s.end()
+				return
+			}
+		}
+	}()
+	return local, 0, nil
+}
@@ -2,7 +2,10 @@ package main
 
 import (
 	"bytes"
-	"encoding/binary"
+	"context"
+	"crypto/hmac"
+	"crypto/tls"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
@@ -10,6 +13,8 @@ import (
 	"os"
 	"strconv"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/google/uuid"
@@ -20,11 +25,35 @@ var (
 		"Where to listen to incoming connections (example 1.2.3.4:8080)")
 	verbose      = flag.Bool("verbose", false, "Turn on verbosity")
 	portRange    = flag.String("allowed", "1-65535", "Allowed destination ports")
+	useTLS       = flag.Bool("tls", false, "Accept keepers over TLS")
+	certFile     = flag.String("cert", "", "TLS certificate file (PEM)")
+	keyFile      = flag.String("key", "", "TLS key file (PEM)")
+	caFile       = flag.String("ca", "", "Require keepers to present a client certificate signed by this CA (PEM)")
+	idleTimeout  = flag.Duration("idle", 0, "Expire sessions with no data moving for this long (0 for never)")
+	detachedTime = flag.Duration("detached", 24*time.Hour, "Expire sessions with no keeper attached for this long (0 for never)")
+	reverseRange = flag.String("reverse", "", "Ports keepers may listen on for reverse tunnels (none by default)")
+	spillDir     = flag.String("spill", "", "Directory to hold session buffers past the -buffer size on disk (memory only by default)")
+	pingEvery    = flag.Duration("ping", 5*time.Second, "Ping keepers this often to notice a dead transport (0 for never)")
+	pingMisses   = flag.Int("misses", 3, "Drop a transport after this many ping intervals with nothing heard from the keeper")
+	dialTimeout  = flag.Duration("dialtimeout", maxOpenTime, "Give up opening a destination, resolving the name and dialing every address, after this long (at most 10s)")
 	allowedPorts map[int]struct{}
+	reversePorts map[int]struct{}
 	version      string
+
+	bufferSize  sizeFlag = 64 << 20
+	memoryLimit sizeFlag
+	spillLimit  sizeFlag
+	budget      *memoryBudget
+
+	// Identifies this server to keepers which reach it by several addresses
+	serverID = uuid.New()
 )
 
 func main() {
+	flag.Var(&bufferSize, "buffer", "Most bytes held for a session before reading from the destination waits (K, M or G suffix, 0 for no limit)")
+	flag.Var(&memoryLimit, "memory", "Most bytes held across all sessions before reading from destinations waits (K, M or G suffix, 0 for no limit)")
+	flag.Var(&spillLimit, "spillmax", "Most bytes held on disk for a session before reading from the destination waits (K, M or G suffix, 0 for no limit)")
+	flag.Var(&ruleList, "rule", "Allow or deny destinations, as \"allow|deny host|cidr [ports]\" with a glob such as *.example.com for the host, may be repeated and the first match decides")
 	flag.Usage = func() {
 		fmt.Fprintf(os.Stderr, "Session-Server (github.com/pschou/session-keeper, version: %s)\n\nUsage: %s [options]\n",
 			version, os.Args[0])
@@ -38,13 +67,55 @@ func main() {
 		os.Exit(1)
 	}
 
+	if *dialTimeout <= 0 || *dialTimeout > maxOpenTime {
+		fmt.Println("Error: -dialtimeout must be more than 0 and at most", maxOpenTime)
+		os.Exit(1)
+	}
 	allowedPorts = hypenRange(*portRange)
+	loadRules()
+	if *reverseRange != "" {
+		reversePorts = hypenRange(*reverseRange)
+	}
+	if *spillDir != "" {
+		if err := sweepSpill(*spillDir); err != nil {
+			fmt.Println("Error preparing spill directory:", err)
+			os.Exit(1)
+		}
+	}
+	if memoryLimit > 0 {
+		budget = newMemoryBudget(int(memoryLimit), nil)
+	}
+	if *identityFile != "" {
+		loadIdentities(*identityFile)
+	}
+	go reapSessions()
 
-	// Listen for incoming connections.
-	l, err := net.Listen("tcp", *listen)
-	if err != nil {
-		fmt.Println("Error listening:", err.Error())
-		os.Exit(1)
+	var cfg *tls.Config
+	if *useTLS {
+		cfg = serverTLSConfig()
+	}
+
+	// Listen for incoming connections, or take over those of the server being
+	// upgraded
+	var l net.Listener
+	if *handoffPath != "" {
+		l = takeOver(*handoffPath)
+	}
+	if l == nil {
+		var err error
+		if l, err = net.Listen("tcp", *listen); err != nil {
+			fmt.Println("Error listening:", err.Error())
+			os.Exit(1)
+		}
+	}
+	if *handoffPath != "" {
+		go serveHandoff(*handoffPath, l, cfg)
+	}
+	if cfg != nil {
+		l = tls.NewListener(l, cfg)
+	}
+	if *peerList != "" {
+		setupCluster(cfg)
 	}
 	// Close the listener when the application closes.
 	defer l.Close()
@@ -53,6 +124,11 @@ func main() {
 		// Listen for an incoming connection.
 		conn, err := l.Accept()
 		if err != nil {
+			if isHandingOff() {
+				// Wait for the listener back in case the upgrade fails
+				l = <-relisten
+				continue
+			}
 			fmt.Println("Error accepting: ", err.Error())
 			os.Exit(1)
 		}
@@ -61,270 +137,719 @@ func main() {
 	}
 }
 
-var (
-	connMap   = make(map[uuid.UUID]*session)
-	connMutex sync.Mutex
-)
+// Build the TLS settings from the flags, exiting when they are unusable
+func serverTLSConfig() *tls.Config {
+	certs, err := loadKeyPair(*certFile, *keyFile)
+	if err != nil || certs == nil {
+		fmt.Println("Error loading TLS certificate:", err)
+		os.Exit(1)
+	}
+	cfg := &tls.Config{Certificates: certs, MinVersion: tls.VersionTLS12}
+	if *caFile != "" {
+		// Mutual TLS, keepers must present a certificate from this CA
+		if cfg.ClientCAs, err = loadCertPool(*caFile); err != nil {
+			fmt.Println("Error loading TLS CA:", err)
+			os.Exit(1)
+		}
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return cfg
+}
+
+// The sessions held are split into shards by their id, so transports coming
+// and going on many sessions at once seldom wait on the same lock
+const sessionShards = 64
+
+type sessionShard struct {
+	mutex sync.Mutex
+	m     map[uuid.UUID]*session
+}
+
+var sessionTable [sessionShards]sessionShard
+
+func shardOf(id uuid.UUID) *sessionShard { return &sessionTable[id[0]%sessionShards] }
+
+func lookupSession(id uuid.UUID) (*session, bool) {
+	sh := shardOf(id)
+	sh.mutex.Lock()
+	defer sh.mutex.Unlock()
+	s, ok := sh.m[id]
+	return s, ok
+}
+
+func storeSession(s *session) {
+	sh := shardOf(s.hdr.UUID)
+	sh.mutex.Lock()
+	if sh.m == nil {
+		sh.m = make(map[uuid.UUID]*session)
+	}
+	sh.m[s.hdr.UUID] = s
+	sh.mutex.Unlock()
+}
+
+// Take a session out of the table, false when it was not there
+func deleteSession(id uuid.UUID) bool {
+	sh := shardOf(id)
+	sh.mutex.Lock()
+	defer sh.mutex.Unlock()
+	_, ok := sh.m[id]
+	delete(sh.m, id)
+	return ok
+}
+
+// Every session held, gathered a shard at a time
+func allSessions() []*session {
+	var list []*session
+	for i := range sessionTable {
+		sh := &sessionTable[i]
+		sh.mutex.Lock()
+		for _, s := range sh.m {
+			list = append(list, s)
+		}
+		sh.mutex.Unlock()
+	}
+	return list
+}
 
 type session struct {
 	hdr *ConnHeader
 
-	buf         bytes.Buffer
-	bufOffset   int64
-	bufMutex    sync.Mutex
+	buf         replayBuffer
 	conn, trans net.Conn
-	C           chan bool
-	closeLocal  bool
+	wake        wakeup
+	state       lifecycle
+
+	// Resumes must prove knowledge of the secret, the previous one is still
+	// accepted in case the keeper missed the reply which rotated it.  The
+	// epoch of the latest resume fences off any older one arriving late.
+	secret, prevSecret []byte
+	epoch              uint64
+	authMutex          sync.Mutex
+
+	// When data last moved and when the transport went away, for expiring,
+	// and whether the keeper has yet to show it got the reply opening it
+	seen, detached time.Time
+	pending        bool
+	stateMutex     sync.Mutex
+
+	// Who opened the session, nil when identities are not set up
+	identity *identity
+
+	// Set while the session is moved to an upgraded server, the destination
+	// reader stops without closing anything and closes readDone
+	handoff  int32
+	readDone chan struct{}
 
-	seen  time.Time
 	mutex sync.Mutex
 }
 
+// How long a keeper has to answer the challenge of a resume
+const proofWait = 10 * time.Second
+
+// Challenge the keeper to prove it holds the session secret, rotating the
+// secret once it has.  A resume older than the latest one is turned away.
+// The secrets are only locked to check and rotate them, so a resume which
+// goes quiet after the challenge holds up no other.
+func (s *session) authenticate(conn net.Conn, hello ConnHeader, epoch uint64) bool {
+	fenced := hello.Caps&capEpoch != 0
+	s.authMutex.Lock()
+	last := s.epoch
+	s.authMutex.Unlock()
+	if fenced && epoch <= last {
+		refuseStale(conn, hello, epoch, last)
+		return false
+	}
+
+	nonce := newSecret()
+	serverOffset := atomic.LoadInt64(&s.hdr.Offset)
+	conn.SetDeadline(time.Now().Add(proofWait))
+	defer conn.SetDeadline(time.Time{})
+	if writeHeader(conn, replyHeader(hello, hdrChallenge, serverOffset),
+		map[byte][]byte{optNonce: nonce}) != nil {
+		return false
+	}
+	proofHdr, opts, err := readHeader(conn)
+	if err != nil || proofHdr.Kind != hdrProof || proofHdr.UUID != hello.UUID {
+		refuse(conn, hello, failProtocol, "expected a proof header")
+		return false
+	}
+	proof := opts[optProof]
+
+	s.authMutex.Lock()
+	var code uint16
+	switch {
+	case fenced && epoch <= s.epoch:
+		// A later resume got through while this one was answering
+		code = failStale
+	case hmac.Equal(proof, resumeProof(s.secret, nonce, hello.UUID, hello.Offset, serverOffset)):
+		s.prevSecret, s.secret = s.secret, rotateSecret(s.secret, nonce)
+	case hmac.Equal(proof, resumeProof(s.prevSecret, nonce, hello.UUID, hello.Offset, serverOffset)):
+		// The keeper never saw the last rotation, carry on from the secret it has
+		s.secret = rotateSecret(s.prevSecret, nonce)
+	default:
+		code = failAuth
+	}
+	if code == 0 && fenced {
+		s.epoch = epoch
+	}
+	last = s.epoch
+	s.authMutex.Unlock()
+
+	switch code {
+	case failStale:
+		refuseStale(conn, hello, epoch, last)
+	case failAuth:
+		log.Println("Failed resume authentication for", hello.UUID.String(), "from", conn.RemoteAddr())
+		refuse(conn, hello, failAuth, "resume authentication failed")
+	}
+	return code == 0
+}
+
+func refuseStale(conn net.Conn, hello ConnHeader, epoch, last uint64) {
+	log.Println("Stale resume of", hello.UUID.String(), "epoch", epoch, "after", last)
+	refuse(conn, hello, failStale, "a later resume has taken over")
+}
+
+// Whether a resume of the given epoch is still the latest
+func (s *session) current(epoch uint64) bool {
+	s.authMutex.Lock()
+	defer s.authMutex.Unlock()
+	return epoch >= s.epoch
+}
+
+// Close the transport attached, if any, so it stops feeding the session
+func (s *session) closeTransport() {
+	s.stateMutex.Lock()
+	if s.trans != nil {
+		s.trans.Close()
+	}
+	s.stateMutex.Unlock()
+}
+
+// Close the destination and forget the session, it is over
+func (s *session) end() {
+	s.conn.Close()
+	s.remove()
+}
+
+// Forget a session, no more resumes will be accepted so the buffer is given
+// back to the memory budget
+func (s *session) remove() {
+	s.state.to(stateClosed)
+	if deleteSession(s.hdr.UUID) {
+		s.identity.release()
+	}
+	s.buf.Free()
+}
+
+// Serve a multiplexed transport, each stream the keeper opens is handled as
+// if it were a connection of its own
+func serveMux(conn net.Conn, hello ConnHeader) {
+	if writeHeader(conn, replyHeader(hello, hdrEstablished, 0), nil) != nil {
+		return
+	}
+	if *verbose {
+		log.Println("Multiplexing sessions from", conn.RemoteAddr())
+	}
+	m := newMux(conn, false, newHeartbeat(*pingEvery, *pingMisses))
+	defer m.Close()
+	for {
+		stream, err := m.Accept()
+		if err != nil {
+			if *verbose {
+				log.Println("Multiplexed transport closed from", conn.RemoteAddr())
+			}
+			return
+		}
+		go handleRequest(stream)
+	}
+}
+
+// Check a requested destination is allowed and dial it, giving the failure
+// code to report when it cannot be reached
+func dialDest(hostport string, id *identity) (net.Conn, uint16, error) {
+	if *verbose {
+		log.Println("got hostport:", hostport)
+	}
+	host, port, err := net.SplitHostPort(hostport)
+	if err != nil {
+		log.Println("Could not parse endpoint:", hostport)
+		return nil, failProtocol, errors.New("could not parse endpoint " + hostport)
+	}
+	p, err := strconv.Atoi(port)
+	if err != nil {
+		log.Println("Could not parse port:", hostport)
+		return nil, failProtocol, errors.New("could not parse port " + hostport)
+	} else if _, ok := allowedPorts[p]; !ok {
+		log.Println("Not an allowed port:", hostport)
+		return nil, failDenied, errors.New("port not allowed " + hostport)
+	}
+	// One deadline covers the resolve and every dial, so the keeper waiting
+	// on the reply is answered before it gives up
+	ctx, cancel := context.WithTimeout(context.Background(), *dialTimeout)
+	defer cancel()
+	ips, err := allowedAddrs(ctx, host, p, id)
+	if err != nil {
+		log.Println("Could not resolve requested endpoint:", hostport)
+		if ctx.Err() != nil {
+			return nil, failTimeout, err
+		}
+		return nil, failResolve, err
+	} else if len(ips) == 0 {
+		return nil, failDenied, errors.New("destination not allowed " + hostport)
+	}
+
+	// Dial the addresses checked rather than the name, which could resolve
+	// differently a second time
+	var dstConn net.Conn
+	var dialer net.Dialer
+	for _, ip := range ips {
+		if *verbose {
+			log.Println("Dialing", hostport, "at", ip)
+		}
+		if dstConn, err = dialer.DialContext(ctx, "tcp", net.JoinHostPort(ip.String(), port)); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		log.Println("Could not dial requested endpoint:", hostport, err)
+		return nil, dialFailure(err), err
+	}
+	return dstConn, 0, nil
+}
+
+// Work out the failure code to report for an error dialing a destination
+func dialFailure(err error) uint16 {
+	var ne net.Error
+	if errors.As(err, &ne) && ne.Timeout() {
+		return failTimeout
+	} else if errors.Is(err, syscall.ECONNREFUSED) {
+		return failRefused
+	}
+	return failDial
+}
+
+// Start a session around a destination connection, keeping reads going on in
+// the background
+func newSession(hdr *ConnHeader, dstConn net.Conn, id *identity) *session {
+	s := &session{
+		wake:     newWakeup(),
+		hdr:      hdr,
+		conn:     dstConn,
+		secret:   newSecret(),
+		readDone: make(chan struct{}),
+		identity: id,
+	}
+	s.buf.limit, s.buf.budget = int(bufferSize), budget
+	if id != nil && id.quota != nil {
+		s.buf.budget = id.quota
+	}
+	s.buf.spill = newSpill(*spillDir, int64(spillLimit))
+	s.seen = time.Now()
+	s.detached = s.seen
+	s.pending = true
+	go readFromDST(s)
+	storeSession(s)
+	return s
+}
+
 // Handle inbound connections, matching up any previously established sessions to
 // properly handle the reconnect.
 func handleRequest(conn net.Conn) {
 	defer conn.Close()
+	if isHandingOff() {
+		// The upgraded server answers once it has taken over
+		return
+	}
 	if *verbose {
 		log.Println("incoming from", conn.RemoteAddr())
 	}
 
-	var rcvHdr ConnHeader
-	binary.Read(conn, binary.BigEndian, &rcvHdr)
-	if bytes.Equal(rcvHdr.UUID[:], make([]byte, 16)) {
-		// All zeros on new connection, impossible!
+	rcvHdr, opts, err := readHeader(conn)
+	if err != nil {
+		if *verbose {
+			log.Println("Could not read header", err)
+		}
 		return
 	}
 	if *verbose {
 		log.Println("hdr", rcvHdr)
 	}
+	if rcvHdr.Version < protoMinVersion {
+		refuse(conn, rcvHdr, failVersion, fmt.Sprintf("protocol version %d is not supported", rcvHdr.Version))
+		return
+	}
+	if rcvHdr.Kind == hdrMux {
+		serveMux(conn, rcvHdr)
+		return
+	}
+	if rcvHdr.Kind == hdrLookup {
+		serveLookup(conn, rcvHdr)
+		return
+	}
+	if bytes.Equal(rcvHdr.UUID[:], make([]byte, 16)) {
+		// All zeros on new connection, impossible!
+		refuse(conn, rcvHdr, failProtocol, "missing session id")
+		return
+	}
 
-	connMutex.Lock()
-	mySession, ok := connMap[rcvHdr.UUID]
-	connMutex.Unlock()
+	mySession, ok := lookupSession(rcvHdr.UUID)
+	if ok && rcvHdr.Kind == hdrNew && mySession.retried(conn, opts) {
+		// The keeper never got the reply opening the session and is asking
+		// again, so only one destination connection is held for it
+		log.Println("Replacing session", rcvHdr.UUID.String(), "the keeper never took up")
+		mySession.closeTransport()
+		mySession.end()
+		ok = false
+	}
+	isNew := !ok
 	if !ok {
 		if *verbose {
 			log.Println("unmatched uuid", rcvHdr.UUID.String())
 		}
 		// Session lookup failed
-		if rcvHdr.Offset != -1 {
-			// Unrecognized session, just close
+		if rcvHdr.Kind != hdrNew && isExpired(rcvHdr.UUID) {
+			refuse(conn, rcvHdr, failExpired, "session expired")
+			return
+		} else if rcvHdr.Kind != hdrNew {
+			code := uint16(failUnknown)
+			if _, fwd := opts[optForwarded]; len(peers) > 0 && !fwd {
+				// Another server of the cluster may hold it
+				if code = forwardToPeer(conn, rcvHdr, opts); code == 0 {
+					return
+				}
+			}
+			if code == failExpired {
+				refuse(conn, rcvHdr, failExpired, "session expired")
+				return
+			}
+			// Unrecognized session, let the keeper know it is gone
+			refuse(conn, rcvHdr, failUnknown, "unknown session")
 			return
 		}
 
-		// On an initial connection, do handshake
-		hostport, err := ReadLine(conn, '\n')
-		if *verbose {
-			log.Println("got hostport:", hostport)
-		}
-		if err != nil {
-			log.Println("Could not find a requested endpoint")
+		if rcvHdr.Caps&capAuth == 0 {
+			refuse(conn, rcvHdr, failVersion, "resume authentication is required")
 			return
 		}
-		_, port, err := net.SplitHostPort(hostport)
-		if err != nil {
-			log.Println("Could not parse endpoint:", hostport)
-			return
+
+		// Keepers must say who they are when identities are set up
+		var id *identity
+		if *identityFile != "" {
+			if id, err = identify(conn, opts[optToken]); err != nil {
+				log.Println("Refused new session from", conn.RemoteAddr(), err)
+				refuse(conn, rcvHdr, failAuth, err.Error())
+				return
+			}
 		}
-		if p, err := strconv.Atoi(port); err != nil {
-			log.Println("Could not parse port:", hostport)
-			return
-		} else if _, ok := allowedPorts[p]; !ok {
-			log.Println("Not an allowed port:", hostport)
+		if !id.acquire() {
+			log.Println("Session limit reached for", id)
+			refuse(conn, rcvHdr, failDenied, "session limit reached")
 			return
 		}
 
-		if *verbose {
-			log.Println("Dialing", hostport)
-		}
-		if dstConn, err := net.Dial("tcp", hostport); err == nil {
-			rcvHdr.Offset = -2
-			mySession = &session{
-				C:    make(chan bool, 3),
-				hdr:  &rcvHdr,
-				conn: dstConn,
-				seen: time.Now(),
-			}
-			// keep reads going on in the background
-			go readFromDST(mySession)
-			connMutex.Lock()
-			connMap[rcvHdr.UUID] = mySession
-			connMutex.Unlock()
+		// On an initial connection, do handshake
+		var dstConn net.Conn
+		var code uint16
+		if listenAddr, ok := opts[optListen]; ok {
+			// A reverse tunnel, connections accepted are announced over this session
+			dstConn, code, err = reverseListen(string(listenAddr), id)
 		} else {
-			log.Println("Could not dial requested endpoint:", hostport)
-			// Cannot dial endpoint, just close
+			dstConn, code, err = dialDest(string(opts[optDest]), id)
+		}
+		if err != nil {
+			// Cannot reach endpoint, tell the keeper why
+			id.release()
+			refuse(conn, rcvHdr, code, err.Error())
 			return
 		}
-	} else if *verbose {
-		mySession.trans.Close()
+		rcvHdr.Offset = 0
+		mySession = newSession(&rcvHdr, dstConn, id)
+		if *verbose {
+			log.Println("New session", rcvHdr.UUID.String(), "for", id)
+		}
+	} else if rcvHdr.Kind == hdrNew {
+		refuse(conn, rcvHdr, failProtocol, "session already exists")
+		return
+	} else if !mySession.authenticate(conn, rcvHdr, parseEpoch(opts)) {
+		return
+	} else {
 		if *verbose {
 			log.Println("matched uuid", rcvHdr.UUID.String())
 		}
+		mySession.confirm()
+		// Fence off the transport attached before, it lets go of the session
+		// once its reads have stopped
+		mySession.state.to(stateResuming)
+		mySession.closeTransport()
 	}
 	mySession.mutex.Lock()
 	defer mySession.mutex.Unlock()
+	if atomic.LoadInt32(&mySession.handoff) != 0 {
+		// Got in just as the session was being handed off, leave the transport
+		// for the keeper to resume again with the upgraded server
+		return
+	}
+	if !isNew && !mySession.current(parseEpoch(opts)) {
+		// A later resume got in while waiting, it will take over instead
+		refuse(conn, rcvHdr, failStale, "a later resume has taken over")
+		return
+	}
+	if !isNew {
+		// The transport before has detached by now, this one is taking over
+		mySession.state.to(stateResuming)
+	}
+	mySession.stateMutex.Lock()
 	mySession.trans = conn
+	mySession.stateMutex.Unlock()
+	mySession.attach()
+	defer mySession.detach()
 
-	if rcvHdr.Offset >= 0 && mySession.closeLocal {
-		// EOF the session
+	if rcvHdr.Kind == hdrClose {
+		// Got an EOF signal, close and delete
 		if *verbose {
-			log.Println("Session is in an EOF state, sending EOF signal, closing and deleting session")
+			log.Println("Got an EOF signal from remote, closing and deleting session")
 		}
-		mySession.hdr.Offset = -4
-		binary.Write(conn, binary.BigEndian, mySession.hdr)
-		connMutex.Lock()
-		delete(connMap, rcvHdr.UUID)
-		connMutex.Unlock()
+		mySession.end()
+		writeHeader(conn, replyHeader(rcvHdr, hdrClosed, 0), nil)
 		return
 	}
 
-	if rcvHdr.Offset == -3 {
-		// Got an EOF signal, close and delete
+	if mySession.state.ending() && mySession.buf.Len() == 0 {
+		// EOF the session, everything sent has been acknowledged
 		if *verbose {
-			log.Println("Got an EOF signal from remote, closing and deleting session")
+			log.Println("Session is in an EOF state, sending EOF signal, closing and deleting session")
 		}
-		mySession.closeLocal = true
-		connMutex.Lock()
-		delete(connMap, rcvHdr.UUID)
-		connMutex.Unlock()
+		writeHeader(conn, replyHeader(rcvHdr, hdrClosed, 0), nil)
+		mySession.remove()
 		return
 	}
 
-	err := binary.Write(conn, binary.BigEndian, mySession.hdr)
-	if err != nil {
-		if mySession.hdr.Offset == -2 {
+	reply := replyHeader(rcvHdr, hdrEstablished, atomic.LoadInt64(&mySession.hdr.Offset))
+	replyOpts := map[byte][]byte{optServer: serverID[:]}
+	if isNew {
+		// Hand over the secret needed to resume
+		replyOpts[optSecret] = mySession.secret
+	}
+	if err := writeHeader(conn, reply, replyOpts); err != nil {
+		if isNew {
 			// If this is a new connection, just fail hard
-			mySession.closeLocal = true
-			connMutex.Lock()
-			delete(connMap, rcvHdr.UUID)
-			connMutex.Unlock()
+			mySession.end()
 		}
 		return
 	}
 
-	if mySession.hdr.Offset == -2 {
-		// New session has been established
-		mySession.hdr.Offset = 0
-	}
-
-	if rcvHdr.Offset < mySession.bufOffset || rcvHdr.Offset > mySession.bufOffset+int64(mySession.buf.Len()) {
-		log.Println("Buffer failed to maintain state", rcvHdr.Offset, "vs", mySession.bufOffset,
-			"buf len:", mySession.buf.Len())
-		mySession.closeLocal = true
-		connMutex.Lock()
-		delete(connMap, rcvHdr.UUID)
-		connMutex.Unlock()
+	// Drop what the remote already has and send the rest again
+	if err := mySession.buf.Rewind(rcvHdr.Offset); err != nil {
+		log.Println("Buffer failed to maintain state", err)
+		writeError(conn, failBuffer, err.Error())
+		mySession.end()
 		return
 	}
 
-	// Advance the local buffer if we need to
-	for rcvHdr.Offset > mySession.bufOffset {
-		mySession.bufMutex.Lock()
-		sz := mySession.buf.Next(2)
-		tosend := mySession.buf.Next(int(sz[0])<<8 + int(sz[1]))
-		mySession.bufOffset += int64(len(tosend))
-		mySession.bufMutex.Unlock()
+	// Pings keep the transport busy so one which has gone quiet is noticed,
+	// a keeper without them is left to the TCP timeouts
+	interval := *pingEvery
+	if _, ok := conn.(*muxStream); ok || rcvHdr.Caps&capPing == 0 {
+		// Streams of a multiplexed transport are left to its own keepalive,
+		// so an idle one sends nothing
+		interval = 0
 	}
+	hb := newHeartbeat(interval, *pingMisses)
 
-	// Do the work of the read from remote
+	// Do the work of the read from remote.  The session is not let go of
+	// until the reads have stopped, so two transports never both write to
+	// the destination.
 	var localErr error
-	var close bool
+	var dropped int32 // set once the transport is done with
+	closed := func() bool { return atomic.LoadInt32(&dropped) != 0 }
+	var reading sync.WaitGroup
+	reading.Add(1)
+	defer func() {
+		conn.Close()
+		reading.Wait()
+		if localErr != nil {
+			log.Println("local error", localErr)
+		}
+	}()
 	go func() { // Create thread for reading with close
 		defer func() {
-			close = true
-			mySession.C <- true
+			atomic.StoreInt32(&dropped, 1)
+			mySession.wake.notify()
+			reading.Done()
 		}()
 
-		rcvBuf := make([]byte, 1<<10)
-		for !close { // infinite loop reading from DST
-			n, err := conn.Read(rcvBuf)
-			tosend := rcvBuf[:n]
-			for len(tosend) > 0 {
+		r := getFrameReader(conn)
+		defer putFrameReader(r)
+		heard := !isNew
+		for !closed() { // infinite loop reading frames from the remote
+			conn.SetReadDeadline(hb.deadline())
+			typ, payload, err := readFrame(r)
+			if err == nil && !heard {
+				// The keeper is talking on the session, so it got the reply
+				heard = true
+				mySession.confirm()
+			}
+			if err != nil {
+				if errors.Is(err, os.ErrDeadlineExceeded) {
+					// Nothing heard, let go of the transport so a stuck write gives up too
+					if *verbose {
+						log.Println("Transport timed out", mySession.hdr.UUID.String())
+					}
+					conn.Close()
+				}
+				return
+			}
+			switch typ {
+			case frameData:
 				if *verbose {
-					fmt.Printf("toDST %q  hoff: %d\n", tosend, mySession.hdr.Offset)
+					fmt.Printf("toDST %q  hoff: %d\n", payload, atomic.LoadInt64(&mySession.hdr.Offset))
 				}
-				wn, writeErr := mySession.conn.Write(tosend)
-				mySession.hdr.Offset += int64(wn)
+				wn, writeErr := mySession.conn.Write(payload)
+				atomic.AddInt64(&mySession.hdr.Offset, int64(wn))
+				mySession.touch()
 				if writeErr != nil {
-					mySession.closeLocal = true
+					mySession.state.to(stateClosing)
 					localErr = writeErr
 					return
 				}
-				tosend = tosend[wn:]
-			}
-			if err != nil {
+				// Let the writer see an acknowledgement is owed
+				mySession.wake.notify()
+			case frameAck:
+				off, err := parseAck(payload)
+				if err == nil {
+					err = mySession.buf.Ack(off)
+				}
+				if err != nil {
+					// Either end has lost track of the stream, it cannot go on
+					log.Println("Bad acknowledgement", err)
+					writeError(conn, failBuffer, err.Error())
+					mySession.end()
+					return
+				}
+				if mySession.state.ending() {
+					// The writer may be waiting on the last of it to close
+					mySession.wake.notify()
+				}
+			case framePing:
+				writeFrame(conn, framePong, payload)
+			case frameClose:
+				// Got an EOF signal, close and delete
+				if *verbose {
+					log.Println("Got an EOF signal from remote, closing and deleting session")
+				}
+				mySession.end()
+				return
+			case frameError:
+				localErr = parseError(payload)
 				return
 			}
 		}
 	}()
 
-	// Do the work of the read from local
-	timer := time.NewTicker(time.Second)
-	for !close && !mySession.closeLocal {
+	// Do the work of the read from local, woken only when there is something
+	// to do and by the alarms for pings and delayed acknowledgements
+	var ackOffset int64 = -1
+	var pinger, acker alarm
+	defer pinger.stop()
+	defer acker.stop()
+	if hb.interval > 0 {
+		pinger.set(hb.interval)
+	}
+	mySession.wake.notify() // send anything held back while detached
+	for !closed() && !(mySession.state.ending() && mySession.buf.Len() == 0) {
+		var ackDue bool
 		select {
-		case <-timer.C:
-		case <-mySession.C:
-		}
-		if mySession.buf.Len() == 0 { // simulate activity / empty traffic
-			_, writeErr := conn.Write([]byte{})
-			if writeErr != nil {
-				close = true
+		case <-mySession.wake:
+		case <-pinger.C:
+			if payload, ok := hb.due(); ok && writeFrame(conn, framePing, payload) != nil {
+				atomic.StoreInt32(&dropped, 1)
 			}
+			pinger.set(hb.interval)
+		case <-acker.C:
+			ackDue = true
+			acker.stop()
 		}
-		for mySession.buf.Len() >= 2 && !close {
-			mySession.bufMutex.Lock()
-			b := mySession.buf.Bytes()
-			sz := (int(b[0]) << 8) + int(b[1])
-			tosend := b[2 : 2+sz]
+		for !closed() {
+			tosend, end, err := mySession.buf.Peek(maxFrameData)
+			if err != nil {
+				// The stream is lost, end the session rather than send a gap
+				log.Println("Buffer failed to maintain state", err)
+				writeError(conn, failBuffer, err.Error())
+				mySession.end()
+				atomic.StoreInt32(&dropped, 1)
+				break
+			}
+			if len(tosend) == 0 {
+				break
+			}
 			if *verbose {
-				fmt.Printf("fromDST %q  off: %d buf: %d\n", tosend,
-					mySession.bufOffset, mySession.buf.Len())
+				fmt.Printf("fromDST %q  buf: %d\n", tosend, mySession.buf.Len())
 			}
-			wn, writeErr := conn.Write(tosend)
-			if close || writeErr != nil {
+			if writeErr := writeFrame(conn, frameData, tosend); writeErr != nil {
 				// message failed to send, break connection
 				if *verbose {
 					log.Println("write error", writeErr)
 				}
-				close = true
+				atomic.StoreInt32(&dropped, 1)
 			} else {
-				mySession.buf.Next(wn + 2)
-				mySession.bufOffset += int64(wn)
+				mySession.buf.Sent(end)
 			}
-			mySession.bufMutex.Unlock()
 		}
-		if mySession.closeLocal {
-			if *verbose {
-				log.Println("Closing conn", mySession.hdr.UUID.String())
+		if off := atomic.LoadInt64(&mySession.hdr.Offset); off != ackOffset && !closed() {
+			// Confirm what has been received so the remote can let it go, once
+			// enough has built up or it has waited long enough for more
+			if ackDue || off-ackOffset >= ackEvery {
+				if writeAck(conn, off) != nil {
+					atomic.StoreInt32(&dropped, 1)
+				}
+				ackOffset = off
+				acker.stop()
+			} else if acker.C == nil {
+				acker.set(ackDelay)
 			}
-			conn.Close()
 		}
 	}
-	if localErr != nil {
-		log.Println("local error", localErr)
+	if !closed() && mySession.state.ending() {
+		// Everything has been acknowledged, EOF the session
+		if *verbose {
+			log.Println("Closing conn", mySession.hdr.UUID.String())
+		}
+		writeFrame(conn, frameClose, []byte{closeEOF})
+		mySession.remove()
 	}
 }
 
 func readFromDST(s *session) {
-	// Do the work of the read from local
-	readBuf := make([]byte, 10002)
-	for !s.closeLocal {
-		n, err := s.conn.Read(readBuf[2:])
-		if err != nil {
+	defer close(s.readDone)
+	// Do the work of the read from local, only taking a buffer once there is
+	// something to read into it
+	for !s.state.ending() {
+		waitReadable(s.conn)
+		readBuf := readBufs.Get().(*[readSize]byte)
+		n, err := s.conn.Read(readBuf[:])
+		if err != nil && atomic.LoadInt32(&s.handoff) != 0 {
+			// Being moved to an upgraded server, keep what was read and leave
+			// the destination open
+			s.buf.Write(readBuf[:n])
+			readBufs.Put(readBuf)
+			return
+		} else if err != nil {
 			if *verbose {
 				log.Println("Error reading local", err)
 			}
-			s.closeLocal = true
+			s.state.to(stateClosing)
 		}
 		if *verbose {
-			fmt.Printf("fromDST %q  off: %d  buf: %d\n", readBuf[:n], s.bufOffset, s.buf.Len())
+			fmt.Printf("fromDST %q  buf: %d\n", readBuf[:n], s.buf.Len())
 		}
-		readBuf[0], readBuf[1] = byte(n>>8), byte(n&0xff)
-		s.bufMutex.Lock()
-		s.buf.Write(readBuf[:n+2])
-		s.bufMutex.Unlock()
-		if len(s.C) == 0 {
-			s.C <- true
+		// Waits while the buffer is full, holding back the destination
+		if _, err := s.buf.Write(readBuf[:n]); err != nil {
+			s.state.to(stateClosing)
 		}
+		readBufs.Put(readBuf)
+		s.touch()
+		s.wake.notify()
 	}
 	if *verbose {
 		log.Println("Closing local", s.hdr.UUID.String())
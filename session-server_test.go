@@ -0,0 +1,459 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"flag"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	mrand "math/rand"
+
+	"github.com/google/uuid"
+)
+
+func TestMain(m *testing.M) {
+	flag.Parse()
+	if !testing.Verbose() {
+		log.SetOutput(io.Discard)
+	}
+	allowedPorts = hypenRange(*portRange)
+	loadRules()
+	os.Exit(m.Run())
+}
+
+// Run a session-server on a free port for the length of the test
+func startServer(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go handleRequest(conn)
+		}
+	}()
+	return l.Addr().String()
+}
+
+// Run an echo destination, each connection it closes is reported on the
+// channel returned
+func startEcho(t *testing.T) (string, chan struct{}) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	closed := make(chan struct{}, 100)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+				closed <- struct{}{}
+			}()
+		}
+	}()
+	return l.Addr().String(), closed
+}
+
+// A relay stands in for the network between keeper and server, cut drops
+// every connection through it at once
+type relay struct {
+	addr  string
+	mutex sync.Mutex
+	conns []net.Conn
+}
+
+func startRelay(t *testing.T, target string) *relay {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	r := &relay{addr: l.Addr().String()}
+	go func() {
+		for {
+			in, err := l.Accept()
+			if err != nil {
+				return
+			}
+			out, err := net.Dial("tcp", target)
+			if err != nil {
+				in.Close()
+				continue
+			}
+			r.mutex.Lock()
+			r.conns = append(r.conns, in, out)
+			r.mutex.Unlock()
+			go func() { io.Copy(out, in); out.Close() }()
+			go func() { io.Copy(in, out); in.Close() }()
+		}
+	}()
+	return r
+}
+
+func (r *relay) cut() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for _, c := range r.conns {
+		c.Close()
+	}
+	r.conns = nil
+}
+
+// The keeper end of a session, as much of it as the tests need
+type testKeeper struct {
+	id     uuid.UUID
+	dest   string
+	secret []byte
+	epoch  uint64
+
+	mutex sync.Mutex
+	sent  []byte // everything sent, to send again what the server missed
+	got   []byte // everything echoed back
+}
+
+// A transport attached to the session, read from until it fails
+type testTransport struct {
+	conn  net.Conn
+	done  chan struct{}
+	epoch uint64
+}
+
+// Open the session, or resume it once open, sending again whatever the
+// server did not get before
+func (k *testKeeper) attach(addr string) (*testTransport, error) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	var rcvHdr ConnHeader
+	var rcvOpts map[byte][]byte
+	if k.secret == nil {
+		k.id = uuid.New()
+		rcvHdr, rcvOpts, err = handshake(conn, newHeader(hdrNew, k.id, 0),
+			map[byte][]byte{optDest: []byte(k.dest)}, nil)
+	} else {
+		k.epoch++
+		rcvHdr, rcvOpts, err = handshake(conn, newHeader(hdrResume, k.id, int64(len(k.got))),
+			map[byte][]byte{optEpoch: epochOpt(k.epoch)}, &k.secret)
+	}
+	if err == nil && rcvHdr.Kind == hdrError {
+		err = readError(conn)
+	} else if err == nil && rcvHdr.Kind != hdrEstablished {
+		err = errors.New("session not established")
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if k.secret == nil {
+		k.secret = rcvOpts[optSecret]
+	}
+	conn.SetDeadline(time.Time{})
+	tr := &testTransport{conn: conn, done: make(chan struct{}), epoch: k.epoch}
+	for _, p := range chunks(k.sent[rcvHdr.Offset:]) {
+		if writeFrame(conn, frameData, p) != nil {
+			break
+		}
+	}
+	go k.read(tr)
+	return tr, nil
+}
+
+func chunks(p []byte) (out [][]byte) {
+	for len(p) > maxFrameData {
+		out, p = append(out, p[:maxFrameData]), p[maxFrameData:]
+	}
+	if len(p) > 0 {
+		out = append(out, p)
+	}
+	return
+}
+
+func (k *testKeeper) read(tr *testTransport) {
+	defer close(tr.done)
+	r := bufio.NewReader(tr.conn)
+	for {
+		typ, payload, err := readFrame(r)
+		if err != nil {
+			return
+		}
+		switch typ {
+		case frameData:
+			k.mutex.Lock()
+			k.got = append(k.got, payload...)
+			off := int64(len(k.got))
+			k.mutex.Unlock()
+			writeAck(tr.conn, off)
+		case framePing:
+			writeFrame(tr.conn, framePong, payload)
+		case frameClose, frameError:
+			tr.conn.Close()
+			return
+		}
+	}
+}
+
+// Send random data on the session, it is held for sending again whether or
+// not it makes it
+func (k *testKeeper) send(tr *testTransport, n int) error {
+	p := make([]byte, n)
+	rand.Read(p)
+	k.mutex.Lock()
+	k.sent = append(k.sent, p...)
+	k.mutex.Unlock()
+	return writeFrame(tr.conn, frameData, p)
+}
+
+// Wait for everything sent to come back, and check it came back intact
+func (k *testKeeper) verify(t *testing.T) {
+	t.Helper()
+	for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		k.mutex.Lock()
+		got, sent := len(k.got), len(k.sent)
+		k.mutex.Unlock()
+		if got >= sent {
+			break
+		}
+	}
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	if !bytes.Equal(k.got, k.sent) {
+		t.Fatalf("echoed %d bytes back for %d sent, or not the same bytes", len(k.got), len(k.sent))
+	}
+}
+
+func waitDone(t *testing.T, tr *testTransport, what string) {
+	t.Helper()
+	select {
+	case <-tr.done:
+	case <-time.After(5 * time.Second):
+		t.Fatal(what)
+	}
+}
+
+func remoteCode(err error) uint16 {
+	var re *remoteError
+	if errors.As(err, &re) {
+		return re.Code
+	}
+	return 0
+}
+
+// Data sent while the transport is cut again and again arrives once, in
+// order, with nothing lost
+func TestResumeAfterCut(t *testing.T) {
+	dest, _ := startEcho(t)
+	r := startRelay(t, startServer(t))
+	k := &testKeeper{dest: dest}
+	for round := 0; round < 20; round++ {
+		tr, err := k.attach(r.addr)
+		if err != nil {
+			t.Fatalf("round %d: %s", round, err)
+		}
+		go func() {
+			time.Sleep(time.Duration(mrand.Intn(5000)) * time.Microsecond)
+			r.cut()
+		}()
+		for i := 0; i < 20; i++ {
+			if k.send(tr, 1+mrand.Intn(3*maxFrameData)) != nil {
+				break
+			}
+		}
+		waitDone(t, tr, "transport not dropped by the cut")
+	}
+	tr, err := k.attach(r.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tr.conn.Close()
+	k.verify(t)
+}
+
+// A later resume takes the session from the transport attached before, and
+// one older than it is refused
+func TestResumeEpochFencing(t *testing.T) {
+	dest, _ := startEcho(t)
+	srv := startServer(t)
+	k := &testKeeper{dest: dest}
+	first, err := k.attach(srv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	k.send(first, 100)
+	k.verify(t)
+
+	// The first transport is still up when the second takes over
+	second, err := k.attach(srv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.conn.Close()
+	waitDone(t, first, "transport taken over was left attached")
+	writeFrame(first.conn, frameData, []byte("never delivered"))
+
+	// A resume given up on turning up late, no later than the one taking over
+	stale := &testKeeper{id: k.id, dest: dest, secret: append([]byte(nil), k.secret...), epoch: second.epoch - 1}
+	k.mutex.Lock()
+	stale.got = k.got
+	k.mutex.Unlock()
+	if _, err := stale.attach(srv); remoteCode(err) != failStale {
+		t.Fatalf("stale resume got %v, want a stale refusal", err)
+	}
+
+	k.send(second, 100)
+	k.verify(t)
+}
+
+// Resumes racing one another leave at most one transport attached, the
+// others refused or dropped
+func TestResumeRace(t *testing.T) {
+	dest, _ := startEcho(t)
+	srv := startServer(t)
+	k := &testKeeper{dest: dest}
+	tr, err := k.attach(srv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr.conn.Close()
+	<-tr.done
+
+	var wg sync.WaitGroup
+	attached := make(chan *testTransport, 8)
+	for i := 1; i <= 8; i++ {
+		racer := &testKeeper{id: k.id, dest: dest, secret: append([]byte(nil), k.secret...), epoch: uint64(i)}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if tr, err := racer.attach(srv); err == nil {
+				attached <- tr
+			}
+		}()
+	}
+	wg.Wait()
+	close(attached)
+	time.Sleep(500 * time.Millisecond)
+	live := 0
+	for tr := range attached {
+		select {
+		case <-tr.done:
+		default:
+			live++
+		}
+		tr.conn.Close()
+	}
+	if live > 1 {
+		t.Fatalf("%d transports left attached to one session", live)
+	}
+}
+
+// Closing a session whose transport is being cut ends it on the server and
+// at the destination, and it cannot be resumed after
+func TestCloseWhileCut(t *testing.T) {
+	dest, destClosed := startEcho(t)
+	srv := startServer(t)
+	r := startRelay(t, srv)
+	for i := 0; i < 5; i++ {
+		k := &testKeeper{dest: dest}
+		tr, err := k.attach(r.addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		k.send(tr, 1000)
+		k.verify(t)
+		cut := make(chan struct{})
+		go func() {
+			time.Sleep(time.Duration(mrand.Intn(2000)) * time.Microsecond)
+			r.cut()
+			close(cut)
+		}()
+		k.send(tr, 1000)
+
+		conn, err := net.Dial("tcp", srv)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		k.mutex.Lock()
+		rcvHdr, _, err := handshake(conn, newHeader(hdrClose, k.id, int64(len(k.got))),
+			map[byte][]byte{optEpoch: epochOpt(k.epoch + 1)}, &k.secret)
+		k.epoch++
+		k.mutex.Unlock()
+		conn.Close()
+		if err != nil || rcvHdr.Kind != hdrClosed {
+			t.Fatalf("close answered with kind %d, %v", rcvHdr.Kind, err)
+		}
+		waitDone(t, tr, "transport left attached after the close")
+
+		select {
+		case <-destClosed:
+		case <-time.After(5 * time.Second):
+			t.Fatal("destination left open after the close")
+		}
+		if _, ok := lookupSession(k.id); ok {
+			t.Fatal("session still held after the close")
+		}
+		if _, err := k.attach(srv); remoteCode(err) != failUnknown {
+			t.Fatalf("resume after the close got %v, want unknown session", err)
+		}
+		<-cut
+	}
+}
+
+// A peer is only told which server holds a session once it has proven it
+// holds the cluster key
+func TestClusterLookup(t *testing.T) {
+	dest, _ := startEcho(t)
+	srv := startServer(t)
+	peers, peerKey = []string{srv}, []byte("cluster key")
+	defer func() { peers, peerKey = nil, nil }()
+	k := &testKeeper{dest: dest}
+	tr, err := k.attach(srv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tr.conn.Close()
+
+	if addr, code := lookupPeer(k.id); addr != srv {
+		t.Fatalf("lookup found %q with code %d, want %s", addr, code, srv)
+	}
+	if addr, code := lookupPeer(uuid.New()); addr != "" || code != failUnknown {
+		t.Fatalf("lookup of an unknown session found %q with code %d", addr, code)
+	}
+
+	conn, err := net.Dial("tcp", srv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	wrong := []byte("not the cluster key")
+	rcvHdr, _, err := handshake(conn, newHeader(hdrLookup, k.id, 0), nil, &wrong)
+	if err != nil || rcvHdr.Kind != hdrError {
+		t.Fatalf("lookup with the wrong key answered with kind %d, %v", rcvHdr.Kind, err)
+	}
+	if code := remoteCode(readError(conn)); code != failAuth {
+		t.Fatalf("lookup with the wrong key got code %d, want an auth failure", code)
+	}
+}